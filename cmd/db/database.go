@@ -2,10 +2,12 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"github.com/ReallyGreatBand/lab2.2/cmd/db/datastore"
 	"github.com/ReallyGreatBand/lab2.2/httptools"
 	"github.com/ReallyGreatBand/lab2.2/signal"
+	"github.com/ReallyGreatBand/lab2.2/tracing"
 	"log"
 	"net/http"
 	"runtime"
@@ -15,17 +17,85 @@ import (
 var dir = flag.String("dir", ".", "database directory")
 var port = flag.Int("port", 18080, "database port")
 var workers = flag.Int("workers", runtime.NumCPU(), "number of allowed workers")
+var compactIndex = flag.Bool("compact-index", false, "keep only key hashes in memory for sealed segments")
+var cacheBytes = flag.Int64("cache-bytes", 0, "size budget of the value cache in bytes, 0 disables it")
+var compressAbove = flag.Int("compress-above", 0, "compress values of at least this many bytes, 0 disables compression")
+// exportCompleteTrailer is set on dumps that were written completely.
+const exportCompleteTrailer = "X-Export-Complete"
+
+var bloomFPRate = flag.Float64("bloom-fp-rate", 0.01, "false-positive rate of segment Bloom filters between 0 and 1, 0 disables them")
 
 func main() {
 	flag.Parse()
 
-	db, err := datastore.NewDb(*dir, datastore.DefaultSegment, *workers)
+	var opts []datastore.Option
+	if *compactIndex {
+		opts = append(opts, datastore.WithCompactIndex())
+	}
+	if *bloomFPRate != 0 {
+		opts = append(opts, datastore.WithBloomFilter(*bloomFPRate))
+	}
+	if *compressAbove > 0 {
+		opts = append(opts, datastore.WithCompression(*compressAbove))
+	}
+	if *cacheBytes > 0 {
+		opts = append(opts, datastore.WithCache(*cacheBytes))
+	}
+
+	db, err := datastore.NewDb(*dir, datastore.DefaultSegment, *workers, opts...)
 	if err != nil {
 		log.Fatalf("Database initialization failed: %s", err)
 	}
 
 	h := new(http.ServeMux)
 
+	h.HandleFunc("/db/_stats", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("content-type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(rw).Encode(db.Stats())
+	})
+
+	h.HandleFunc("/db/_export", func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		// The status is sent before the dump is streamed, so completion is
+		// announced in a trailer and a failed export cuts the stream short.
+		rw.Header().Set("content-type", "application/x-ndjson")
+		rw.Header().Set("Trailer", exportCompleteTrailer)
+		rw.WriteHeader(http.StatusOK)
+		if err := db.Export(rw); err != nil {
+			log.Printf("Export failed: %s (%s)", err, requestTrace(r))
+			panic(http.ErrAbortHandler)
+		}
+		rw.Header().Set(exportCompleteTrailer, "true")
+	})
+
+	h.HandleFunc("/db/_import", func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		rw.Header().Set("content-type", "application/json")
+		count, err := db.Import(r.Body)
+		if err != nil {
+			log.Printf("Import failed after %d records: %s (%s)", count, err, requestTrace(r))
+			if errors.Is(err, datastore.ErrMalformedRecord) {
+				rw.WriteHeader(http.StatusBadRequest)
+			} else {
+				rw.WriteHeader(http.StatusInternalServerError)
+			}
+		} else {
+			rw.WriteHeader(http.StatusOK)
+		}
+		_ = json.NewEncoder(rw).Encode(struct {
+			Imported int `json:"imported"`
+		}{
+			Imported: count,
+		})
+	})
+
 	h.HandleFunc("/db/", func(rw http.ResponseWriter, r *http.Request) {
 		rw.Header().Set("content-type", "application/json")
 		key := strings.Split(r.URL.Path, "/db/")[1]
@@ -37,6 +107,7 @@ func main() {
 				case datastore.ErrNotFound:
 					rw.WriteHeader(http.StatusNotFound)
 				default:
+					log.Printf("Get %s failed: %s (%s)", key, err, requestTrace(r))
 					rw.WriteHeader(http.StatusInternalServerError)
 				}
 				return
@@ -60,6 +131,7 @@ func main() {
 			}
 			err = db.Put(key, val.Value)
 			if err != nil {
+				log.Printf("Put %s failed: %s (%s)", key, err, requestTrace(r))
 				rw.WriteHeader(http.StatusInternalServerError)
 				return
 			}
@@ -69,7 +141,13 @@ func main() {
 		}
 	})
 
-	server := httptools.CreateServer(*port, h)
+	server := httptools.CreateServer(*port, tracing.Handler(h))
 	server.Start()
 	signal.WaitForTerminationSignal()
 }
+
+// requestTrace identifies the request in logs, see tracing.Handler.
+func requestTrace(r *http.Request) tracing.Trace {
+	trace, _ := tracing.FromContext(r.Context())
+	return trace
+}
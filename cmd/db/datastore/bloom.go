@@ -0,0 +1,96 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+)
+
+const bloomSuffix = ".bloom"
+
+// bloomFilter answers whether a sealed segment may contain a key. It uses
+// double hashing of keyHash to derive the bit positions.
+type bloomFilter struct {
+	bits   []uint64
+	hashes uint32
+	fpRate float64
+}
+
+func newBloomFilter(keys int, fpRate float64) *bloomFilter {
+	if keys < 1 {
+		keys = 1
+	}
+	m := math.Ceil(-float64(keys) * math.Log(fpRate) / (math.Ln2 * math.Ln2))
+	words := int(math.Ceil(m / 64))
+	k := uint32(math.Round(float64(words*64) / float64(keys) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{
+		bits:   make([]uint64, words),
+		hashes: k,
+		fpRate: fpRate,
+	}
+}
+
+func (bf *bloomFilter) positions(key string, fn func(bit uint64)) {
+	hash := keyHash(key)
+	h1, h2 := hash&0xffffffff, hash>>32|1
+	m := uint64(len(bf.bits)) * 64
+	for i := uint64(0); i < uint64(bf.hashes); i++ {
+		fn((h1 + i*h2) % m)
+	}
+}
+
+func (bf *bloomFilter) add(key string) {
+	bf.positions(key, func(bit uint64) {
+		bf.bits[bit/64] |= 1 << (bit % 64)
+	})
+}
+
+func (bf *bloomFilter) mayContain(key string) bool {
+	found := true
+	bf.positions(key, func(bit uint64) {
+		if bf.bits[bit/64]&(1<<(bit%64)) == 0 {
+			found = false
+		}
+	})
+	return found
+}
+
+// save writes the filter next to the segment it was built for. segmentSize
+// lets load detect a filter that does not match the segment anymore.
+func (bf *bloomFilter) save(path string, segmentSize int64) error {
+	data := make([]byte, 20+8*len(bf.bits))
+	binary.LittleEndian.PutUint64(data, uint64(segmentSize))
+	binary.LittleEndian.PutUint64(data[8:], math.Float64bits(bf.fpRate))
+	binary.LittleEndian.PutUint32(data[16:], bf.hashes)
+	for i, word := range bf.bits {
+		binary.LittleEndian.PutUint64(data[20+8*i:], word)
+	}
+	return ioutil.WriteFile(path, data, 0o600)
+}
+
+func loadBloomFilter(path string, segmentSize int64) (*bloomFilter, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 28 || (len(data)-20)%8 != 0 {
+		return nil, fmt.Errorf("bloom filter %s is corrupted", path)
+	}
+	if int64(binary.LittleEndian.Uint64(data)) != segmentSize {
+		return nil, fmt.Errorf("bloom filter %s is stale", path)
+	}
+
+	bf := &bloomFilter{
+		bits:   make([]uint64, (len(data)-20)/8),
+		fpRate: math.Float64frombits(binary.LittleEndian.Uint64(data[8:])),
+		hashes: binary.LittleEndian.Uint32(data[16:]),
+	}
+	for i := range bf.bits {
+		bf.bits[i] = binary.LittleEndian.Uint64(data[20+8*i:])
+	}
+	return bf, nil
+}
@@ -0,0 +1,57 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	bf := newBloomFilter(1000, 0.01)
+	for i := 0; i < 1000; i++ {
+		bf.add(fmt.Sprintf("key%d", i))
+	}
+	for i := 0; i < 1000; i++ {
+		if !bf.mayContain(fmt.Sprintf("key%d", i)) {
+			t.Fatalf("False negative for key%d", i)
+		}
+	}
+
+	positives := 0
+	for i := 0; i < 10000; i++ {
+		if bf.mayContain(fmt.Sprintf("missing%d", i)) {
+			positives++
+		}
+	}
+	if rate := float64(positives) / 10000; rate > 0.03 {
+		t.Errorf("False-positive rate is too high: %f", rate)
+	}
+}
+
+func TestBloomFilter_SaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-bloom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "segment0" + bloomSuffix)
+
+	bf := newBloomFilter(10, 0.05)
+	bf.add("key")
+	if err := bf.save(path, 42); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadBloomFilter(path, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.mayContain("key") || loaded.fpRate != 0.05 || loaded.hashes != bf.hashes {
+		t.Errorf("Loaded filter differs from the saved one")
+	}
+	if _, err := loadBloomFilter(path, 43); err == nil {
+		t.Errorf("Expected a stale filter to be rejected")
+	}
+}
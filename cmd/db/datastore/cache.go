@@ -0,0 +1,84 @@
+package datastore
+
+import (
+	"container/list"
+	"sync"
+)
+
+type cacheItem struct {
+	key, value string
+}
+
+// valueCache is an LRU cache of values whose total size of keys and values
+// stays within budget bytes.
+type valueCache struct {
+	mux    sync.Mutex
+	budget int64
+	size   int64
+	items  map[string]*list.Element
+	order  *list.List
+	hits   uint64
+	misses uint64
+}
+
+func newValueCache(budget int64) *valueCache {
+	return &valueCache{
+		budget: budget,
+		items:  make(map[string]*list.Element),
+		order:  list.New(),
+	}
+}
+
+func (c *valueCache) get(key string) (string, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		c.misses++
+		return "", false
+	}
+	c.hits++
+	c.order.MoveToFront(elem)
+	return elem.Value.(*cacheItem).value, true
+}
+
+func (c *valueCache) add(key, value string) {
+	itemSize := int64(len(key) + len(value))
+	if itemSize > c.budget {
+		return
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.removeLocked(key)
+	c.items[key] = c.order.PushFront(&cacheItem{key: key, value: value})
+	c.size += itemSize
+	for c.size > c.budget {
+		c.removeLocked(c.order.Back().Value.(*cacheItem).key)
+	}
+}
+
+func (c *valueCache) remove(key string) {
+	c.mux.Lock()
+	c.removeLocked(key)
+	c.mux.Unlock()
+}
+
+func (c *valueCache) removeLocked(key string) {
+	elem, ok := c.items[key]
+	if !ok {
+		return
+	}
+	item := c.order.Remove(elem).(*cacheItem)
+	delete(c.items, key)
+	c.size -= int64(len(item.key) + len(item.value))
+}
+
+// stats returns hits, misses and the current size in bytes.
+func (c *valueCache) stats() (uint64, uint64, int64) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.hits, c.misses, c.size
+}
@@ -0,0 +1,37 @@
+package datastore
+
+import "testing"
+
+func TestValueCache(t *testing.T) {
+	c := newValueCache(20)
+	c.add("key1", "value1")
+	c.add("key2", "value2")
+
+	if value, ok := c.get("key1"); !ok || value != "value1" {
+		t.Errorf("Cannot get key1 from cache: %s", value)
+	}
+
+	// key2 is the least recently used one and has to be evicted.
+	c.add("key3", "value3")
+	if _, ok := c.get("key2"); ok {
+		t.Errorf("key2 was not evicted")
+	}
+	if _, ok := c.get("key1"); !ok {
+		t.Errorf("key1 was evicted")
+	}
+
+	c.remove("key1")
+	if _, ok := c.get("key1"); ok {
+		t.Errorf("key1 was not removed")
+	}
+
+	c.add("big", "value that does not fit into the budget")
+	if _, ok := c.get("big"); ok {
+		t.Errorf("Value over the budget was cached")
+	}
+
+	hits, misses, size := c.stats()
+	if hits != 2 || misses != 3 || size != 10 {
+		t.Errorf("Unexpected stats: hits %d, misses %d, size %d", hits, misses, size)
+	}
+}
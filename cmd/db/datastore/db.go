@@ -9,6 +9,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 const DefaultSegment = 10485760
@@ -32,9 +33,71 @@ type Db struct {
 	getChan chan int
 	getCounter safeCounter
 	isClosed bool
+	compactIndex bool
+	bloomFPRate float64
+	cache *valueCache
+	compressAbove int
+	stats *counters
 }
 
-func NewDb(dir string, segmentSize int64, numWorkers int) (*Db, error) {
+// counters are updated atomically by concurrent readers.
+type counters struct {
+	bloomChecks uint64
+	bloomSkips uint64
+	bloomFalsePositives uint64
+}
+
+// Stats describes the state of the database.
+type Stats struct {
+	Segments int `json:"segments"`
+	BloomFalsePositiveRate float64 `json:"bloomFalsePositiveRate"`
+	BloomChecks uint64 `json:"bloomChecks"`
+	BloomSkips uint64 `json:"bloomSkips"`
+	BloomFalsePositives uint64 `json:"bloomFalsePositives"`
+	// BloomObservedRate is the share of lookups for absent keys that the filters let through.
+	BloomObservedRate float64 `json:"bloomObservedRate"`
+	CacheBudget int64 `json:"cacheBudget"`
+	CacheSize int64 `json:"cacheSize"`
+	CacheHits uint64 `json:"cacheHits"`
+	CacheMisses uint64 `json:"cacheMisses"`
+}
+
+// Option configures optional Db features.
+type Option func(db *Db)
+
+// WithCompactIndex makes sealed segments keep only key hashes and offsets in
+// memory instead of a map holding every key, see compactIndex.
+func WithCompactIndex() Option {
+	return func(db *Db) {
+		db.compactIndex = true
+	}
+}
+
+// WithBloomFilter makes every sealed segment carry a persisted Bloom filter
+// with the given false-positive rate, which Get consults before the index.
+// NewDb fails if the rate is not below 1, while 0 leaves the filters off.
+func WithBloomFilter(fpRate float64) Option {
+	return func(db *Db) {
+		db.bloomFPRate = fpRate
+	}
+}
+
+// WithCache enables a read-through LRU cache of values limited to budget bytes.
+func WithCache(budget int64) Option {
+	return func(db *Db) {
+		db.cache = newValueCache(budget)
+	}
+}
+
+// WithCompression stores values of at least threshold bytes gzip-compressed.
+// Compression is transparent to readers and merges.
+func WithCompression(threshold int) Option {
+	return func(db *Db) {
+		db.compressAbove = threshold
+	}
+}
+
+func NewDb(dir string, segmentSize int64, numWorkers int, opts ...Option) (*Db, error) {
 
 	db := &Db{
 		mux: &sync.RWMutex{},
@@ -47,6 +110,13 @@ func NewDb(dir string, segmentSize int64, numWorkers int) (*Db, error) {
 			mux: &sync.Mutex{},
 			counter: 0,
 		},
+		stats: &counters{},
+	}
+	for _, opt := range opts {
+		opt(db)
+	}
+	if !(db.bloomFPRate >= 0 && db.bloomFPRate < 1) {
+		return nil, fmt.Errorf("bloom filter false-positive rate %g must be in [0, 1)", db.bloomFPRate)
 	}
 	err := db.recover()
 	go db.writeWorker()
@@ -63,6 +133,9 @@ func (db *Db) writeWorker() {
 			return
 		}
 		db.mux.Lock()
+		if db.cache != nil {
+			db.cache.remove(record.key)
+		}
 		err := db.tail().put(record.key, record.value)
 		if err != nil {
 			db.mux.Unlock()
@@ -91,16 +164,27 @@ func (db *Db) recover() error {
 	if err != nil {
 		return err
 	}
-	var segments []*segment
+	var paths []string
 	for _, file := range contents {
-		if !file.IsDir() && strings.HasPrefix(file.Name(), segmentPrefix) {
-			segment, err := initSegment(filepath.Join(db.dirPath, file.Name()))
-			if err != nil {
-				return err
-			}
-
-			segments = append(segments, segment)
+		if !file.IsDir() && strings.HasPrefix(file.Name(), segmentPrefix) && filepath.Ext(file.Name()) != bloomSuffix {
+			paths = append(paths, filepath.Join(db.dirPath, file.Name()))
+		}
+	}
+	// Sealed segments get their compact index while they are read, so the
+	// keys are never held in memory all together. Only the active segment,
+	// bounded by the segment size, keeps a map of its keys.
+	var segments []*segment
+	for i, path := range paths {
+		var idx index = make(hashIndex)
+		if db.compactIndex && i < len(paths) - 1 {
+			idx = newCompactIndex(0)
 		}
+		segment, err := initSegment(path, idx)
+		if err != nil {
+			return err
+		}
+
+		segments = append(segments, segment)
 	}
 
 	if len(segments) == 0 {
@@ -119,10 +203,74 @@ func (db *Db) recover() error {
 	}
 
 	db.segments = segments
+	db.tail().compressAbove = db.compressAbove
+	for _, seg := range segments[:len(segments) - 1] {
+		if err := db.seal(seg); err != nil {
+			return err
+		}
+	}
 
 	return err
 }
 
+// seal prepares a segment that no longer receives writes for read-only use.
+func (db *Db) seal(seg *segment) error {
+	if db.bloomFPRate > 0 {
+		if err := seg.loadBloom(db.bloomFPRate); err != nil {
+			return err
+		}
+	}
+	if db.compactIndex {
+		seg.compact()
+	}
+	return nil
+}
+
+// Stats returns the current counters of the database.
+func (db *Db) Stats() Stats {
+	db.mux.RLock()
+	segments := len(db.segments)
+	db.mux.RUnlock()
+
+	stats := Stats{
+		Segments: segments,
+		BloomFalsePositiveRate: db.bloomFPRate,
+		BloomChecks: atomic.LoadUint64(&db.stats.bloomChecks),
+		BloomSkips: atomic.LoadUint64(&db.stats.bloomSkips),
+		BloomFalsePositives: atomic.LoadUint64(&db.stats.bloomFalsePositives),
+	}
+	if negatives := stats.BloomSkips + stats.BloomFalsePositives; negatives > 0 {
+		stats.BloomObservedRate = float64(stats.BloomFalsePositives) / float64(negatives)
+	}
+	if db.cache != nil {
+		stats.CacheBudget = db.cache.budget
+		stats.CacheHits, stats.CacheMisses, stats.CacheSize = db.cache.stats()
+	}
+	return stats
+}
+
+// newIndex returns an index for a segment that is written once and sealed right away.
+func (db *Db) newIndex() index {
+	if db.compactIndex {
+		return newCompactIndex(0)
+	}
+	return make(hashIndex)
+}
+
+// shadowed reports whether any of the newer segments holds a record for key.
+func shadowed(key string, newer []*segment) (bool, error) {
+	for _, seg := range newer {
+		_, _, err := seg.find(key)
+		if err == nil {
+			return true, nil
+		}
+		if err != ErrNotFound {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
 func (db *Db) Close() error {
 	if db.isClosed {
 		return fmt.Errorf("database is already closed")
@@ -166,10 +314,11 @@ func (db *Db) createSegment() error {
 	count, err := strconv.Atoi(name[len(name) - 1:])
 	path := filepath.Join(db.dirPath, fmt.Sprintf("%s%d", segmentPrefix, count + 1))
 
-	seg, err := initSegment(path)
+	seg, err := initSegment(path, make(hashIndex))
 	if err != nil {
 		return err
 	}
+	seg.compressAbove = db.compressAbove
 	db.segments = append(db.segments, seg)
 
 	//mergeChan := merge{close: false}
@@ -182,6 +331,8 @@ func (db *Db) createSegment() error {
 		/*go func() {
 			db.mergeQueue <- mergeChan
 		}()*/
+	} else if err := db.seal(tail); err != nil {
+		return err
 	}
 
 	return nil
@@ -201,36 +352,42 @@ func (db *Db) merge() error {
 		filePath:  newPath,
 		file:      file,
 		outOffset: 0,
-		index:     make(hashIndex),
+		index:     db.newIndex(),
+		compressAbove: db.compressAbove,
+	}
+	if db.bloomFPRate > 0 {
+		keys := 0
+		for _, mergee := range mergees {
+			keys += mergee.index.size()
+		}
+		mergedSeg.bloom = newBloomFilter(keys, db.bloomFPRate)
 	}
-
-	keys := make(map[string]int)
 
 	for i := len(mergees) - 1; i >= 0; i-- {
 		mergee := mergees[i]
-		for key := range mergee.index {
-			if _, exists := keys[key]; exists {
-				continue
-			}
-
-			value, err := mergee.get(key)
-			if err != nil {
-				_ = mergedSeg.close()
-				_ = os.Remove(newPath)
+		newer := mergees[i+1:]
+		_, err := mergee.scan(func(e *entry, offset int64) error {
+			latest, err := mergee.isLatest(e.key, offset)
+			if err != nil || !latest {
 				return err
 			}
-
-			err = mergedSeg.put(key, value)
-			if err != nil {
-				_ = mergedSeg.close()
-				_ = os.Remove(newPath)
+			if skip, err := shadowed(e.key, newer); err != nil || skip {
 				return err
 			}
-			
-			keys[key] = 1
+			if mergedSeg.bloom != nil {
+				mergedSeg.bloom.add(e.key)
+			}
+			return mergedSeg.put(e.key, e.value)
+		})
+		if err != nil {
+			_ = mergedSeg.close()
+			_ = os.Remove(newPath)
+			return err
 		}
 	}
-
+	if ci, ok := mergedSeg.index.(*compactIndex); ok {
+		ci.seal()
+	}
 
 	newSeg := []*segment{mergedSeg}
 	db.segments = append(newSeg, db.segments[len(mergees):]...)
@@ -254,7 +411,11 @@ func (db *Db) merge() error {
 		_ = segment.close()
 		if segment != mergees[0] {
 			_ = os.Remove(segment.filePath)
+			_ = os.Remove(segment.filePath + bloomSuffix)
 		}
 	}
+	if mergedSeg.bloom != nil {
+		return mergedSeg.bloom.save(mergedSeg.filePath + bloomSuffix, mergedSeg.outOffset)
+	}
 	return nil
 }
\ No newline at end of file
@@ -1,12 +1,18 @@
 package datastore
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 var testSize int64 = 256
@@ -222,3 +228,398 @@ func TestDb_Put(t *testing.T) {
 		}
 	})
 }
+
+func TestDb_ExportImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pairs := map[string]string {
+		"key1": "value1",
+		"key2": "value2",
+		"key3": "value3",
+	}
+	for k, v := range pairs {
+		if err := db.Put(k, v); err != nil {
+			t.Fatalf("Cannot put %s: %s", k, err)
+		}
+	}
+	if err := db.Put("key1", "updated"); err != nil {
+		t.Fatalf("Cannot put key1: %s", err)
+	}
+	pairs["key1"] = "updated"
+
+	var dump bytes.Buffer
+	if err := db.Export(&dump); err != nil {
+		t.Fatalf("Cannot export: %s", err)
+	}
+	if lines := strings.Count(dump.String(), "\n"); lines != len(pairs) {
+		t.Errorf("Unexpected number of exported records: %d", lines)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	importDir, err := ioutil.TempDir("", "test-db-import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(importDir)
+
+	imported, err := NewDb(importDir, 64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer imported.Close()
+
+	count, err := imported.Import(&dump)
+	if err != nil {
+		t.Fatalf("Cannot import: %s", err)
+	}
+	if count != len(pairs) {
+		t.Errorf("Unexpected number of imported records: %d", count)
+	}
+	for k, v := range pairs {
+		value, err := imported.Get(k)
+		if err != nil {
+			t.Errorf("Cannot get %s: %s", k, err)
+		}
+		if value != v {
+			t.Errorf("Bad value returned expected %s, got %s", v, value)
+		}
+	}
+
+	if _, err := imported.Import(strings.NewReader(`{"key": "broken"`)); !errors.Is(err, ErrMalformedRecord) {
+		t.Errorf("Expected a malformed record error, got %v", err)
+	}
+}
+
+func TestDb_ExportLargeSegments(t *testing.T) {
+	for name, opts := range map[string][]Option{"hash": nil, "compact": {WithCompactIndex()}} {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "test-db-export-large")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			db, err := NewDb(dir, 1<<20, 1, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			pairs := map[string]string{}
+			for i := 0; i < 2000; i++ {
+				key := fmt.Sprintf("key%d", i%500)
+				value := fmt.Sprintf("value%d-%s", i, strings.Repeat("x", 64))
+				if err := db.Put(key, value); err != nil {
+					t.Fatal(err)
+				}
+				pairs[key] = value
+			}
+
+			var dump bytes.Buffer
+			if err := db.Export(&dump); err != nil {
+				t.Fatalf("Cannot export: %s", err)
+			}
+			exported := map[string]string{}
+			dec := json.NewDecoder(&dump)
+			for dec.More() {
+				var rec record
+				if err := dec.Decode(&rec); err != nil {
+					t.Fatal(err)
+				}
+				exported[rec.Key] = rec.Value
+			}
+			if !reflect.DeepEqual(exported, pairs) {
+				t.Errorf("Exported %d records, expected the latest values of %d keys", len(exported), len(pairs))
+			}
+		})
+	}
+}
+
+// blockedWriter holds the first write until release is closed.
+type blockedWriter struct {
+	started chan struct{}
+	release chan struct{}
+	buf bytes.Buffer
+}
+
+func (bw *blockedWriter) Write(p []byte) (int, error) {
+	if bw.buf.Len() == 0 {
+		close(bw.started)
+		<-bw.release
+	}
+	return bw.buf.Write(p)
+}
+
+func TestDb_ExportConcurrentPut(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-export-put")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := &blockedWriter{started: make(chan struct{}), release: make(chan struct{})}
+	exported := make(chan error)
+	go func() {
+		exported <- db.Export(w)
+	}()
+	<-w.started
+
+	// Writes go on, creating and merging segments, while the client is stuck.
+	put := make(chan error)
+	go func() {
+		for i := 0; i < 20; i++ {
+			if err := db.Put(fmt.Sprintf("new%d", i), "value"); err != nil {
+				put <- err
+				return
+			}
+		}
+		put <- nil
+	}()
+	select {
+	case err := <-put:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		close(w.release)
+		t.Fatal("Put is blocked by the export")
+	}
+
+	close(w.release)
+	if err := <-exported; err != nil {
+		t.Fatalf("Cannot export: %s", err)
+	}
+	if lines := strings.Count(w.buf.String(), "\n"); lines != 10 {
+		t.Errorf("Unexpected number of exported records: %d", lines)
+	}
+	if strings.Contains(w.buf.String(), "new") {
+		t.Error("Export contains records put after it started")
+	}
+}
+
+func TestDb_CompactIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-compact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 64, 1, WithCompactIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pairs := map[string]string {}
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key%d", i % 7)
+		value := fmt.Sprintf("value%d", i)
+		if err := db.Put(key, value); err != nil {
+			t.Fatalf("Cannot put %s: %s", key, err)
+		}
+		pairs[key] = value
+	}
+	if len(db.segments) < 2 {
+		t.Fatalf("Expected the database to be segmented, got %d segments", len(db.segments))
+	}
+	if _, ok := db.segments[0].index.(*compactIndex); !ok {
+		t.Errorf("Sealed segment is not compacted")
+	}
+
+	check := func() {
+		for k, v := range pairs {
+			value, err := db.Get(k)
+			if err != nil {
+				t.Errorf("Cannot get %s: %s", k, err)
+			}
+			if value != v {
+				t.Errorf("Bad value returned expected %s, got %s", v, value)
+			}
+		}
+	}
+	check()
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDb(dir, 64, 1, WithCompactIndex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, ok := db.segments[0].index.(*compactIndex); !ok {
+		t.Errorf("Recovered sealed segment is not compacted")
+	}
+	check()
+}
+
+func TestDb_BloomFilterRate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-bloom-rate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, rate := range []float64{1, 1.5, -0.1, math.NaN()} {
+		if _, err := NewDb(dir, 64, 1, WithBloomFilter(rate)); err == nil {
+			t.Errorf("Expected an error for false-positive rate %g", rate)
+		}
+	}
+}
+
+func TestDb_BloomFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-bloom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 64, 1, WithBloomFilter(0.01))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+			t.Fatalf("Cannot put key%d: %s", i, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, segmentPrefix + "0" + bloomSuffix)); err != nil {
+		t.Errorf("Bloom filter was not persisted: %s", err)
+	}
+
+	if _, err := db.Get("missing"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if value, err := db.Get("key0"); err != nil || value != "value" {
+		t.Errorf("Cannot get key0: %v %s", err, value)
+	}
+
+	stats := db.Stats()
+	if stats.BloomChecks == 0 || stats.BloomSkips + stats.BloomFalsePositives == 0 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+	if stats.BloomFalsePositiveRate != 0.01 {
+		t.Errorf("Unexpected configured rate: %f", stats.BloomFalsePositiveRate)
+	}
+}
+
+func TestDb_Cache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, testSize, 1, WithCache(1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("key", "value1"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if value, err := db.Get("key"); err != nil || value != "value1" {
+			t.Errorf("Cannot get key: %v %s", err, value)
+		}
+	}
+	if err := db.Put("key", "value2"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("key"); err != nil || value != "value2" {
+		t.Errorf("Stale value returned after put: %v %s", err, value)
+	}
+
+	stats := db.Stats()
+	if stats.CacheHits != 2 || stats.CacheMisses != 2 {
+		t.Errorf("Unexpected cache stats: %+v", stats)
+	}
+}
+
+func TestDb_Compression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-compression")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 512, 1, WithCompression(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pairs := map[string]string {}
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key%d", i % 4)
+		pairs[key] = strings.Repeat(fmt.Sprintf(`{"value": %d}`, i), 20)
+		if err := db.Put(key, pairs[key]); err != nil {
+			t.Fatalf("Cannot put %s: %s", key, err)
+		}
+	}
+	pairs["short"] = "value"
+	if err := db.Put("short", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	rawSize := 0
+	for k, v := range pairs {
+		rawSize += len(k) + len(v) + 12
+	}
+	if size := db.tail().outOffset; size >= int64(rawSize) {
+		t.Errorf("Tail segment was not compressed: %d bytes", size)
+	}
+
+	check := func() {
+		for k, v := range pairs {
+			value, err := db.Get(k)
+			if err != nil {
+				t.Errorf("Cannot get %s: %s", k, err)
+			}
+			if value != v {
+				t.Errorf("Bad value returned expected %s, got %s", v, value)
+			}
+		}
+	}
+	check()
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDb(dir, 64, 1, WithCompression(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 3; i++ {
+		if err := db.Put("merge", strings.Repeat("value", 20)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pairs["merge"] = strings.Repeat("value", 20)
+	check()
+}
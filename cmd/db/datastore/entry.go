@@ -2,10 +2,19 @@ package datastore
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
 )
 
+// compressedFlag is set in the size field of the record header when the
+// value is stored gzip-compressed.
+const compressedFlag = 1 << 31
+
 type entry struct {
 	key, value string
 }
@@ -35,11 +44,46 @@ func (e *entry) Decode(input []byte) {
 	e.value = string(valBuf)
 }
 
+// encodeCompressed encodes the record with its value compressed. It reports
+// false when compression does not make the value smaller.
+func (e *entry) encodeCompressed() ([]byte, bool, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write([]byte(e.value)); err != nil {
+		return nil, false, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, false, err
+	}
+	if buf.Len() >= len(e.value) {
+		return nil, false, nil
+	}
+
+	compressed := entry{key: e.key, value: buf.String()}
+	res := compressed.Encode()
+	binary.LittleEndian.PutUint32(res, binary.LittleEndian.Uint32(res)|compressedFlag)
+	return res, true, nil
+}
+
+func decompress(value string) (string, error) {
+	r, err := gzip.NewReader(strings.NewReader(value))
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
 func readValue(in *bufio.Reader) (string, error) {
 	header, err := in.Peek(8)
 	if err != nil {
 		return "", err
 	}
+	compressed := binary.LittleEndian.Uint32(header)&compressedFlag != 0
 	keySize := int(binary.LittleEndian.Uint32(header[4:]))
 	_, err = in.Discard(keySize + 8)
 	if err != nil {
@@ -65,5 +109,35 @@ func readValue(in *bufio.Reader) (string, error) {
 		return "", fmt.Errorf("can't read value bytes (read %d, expected %d)", n, valSize)
 	}
 
+	if compressed {
+		return decompress(string(data))
+	}
 	return string(data), nil
 }
+
+// readEntry reads a whole record and returns it together with its size on disk.
+func readEntry(in *bufio.Reader) (*entry, int, error) {
+	header, err := in.Peek(4)
+	if err != nil {
+		return nil, 0, err
+	}
+	size := int(binary.LittleEndian.Uint32(header) &^ compressedFlag)
+	compressed := binary.LittleEndian.Uint32(header)&compressedFlag != 0
+	if size < 12 {
+		return nil, 0, fmt.Errorf("corrupted record of size %d", size)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(in, data); err != nil {
+		return nil, 0, err
+	}
+
+	var e entry
+	e.Decode(data)
+	if compressed {
+		if e.value, err = decompress(e.value); err != nil {
+			return nil, 0, err
+		}
+	}
+	return &e, size, nil
+}
@@ -3,6 +3,7 @@ package datastore
 import (
 	"bufio"
 	"bytes"
+	"strings"
 	"testing"
 )
 
@@ -28,3 +29,34 @@ func TestReadValue(t *testing.T) {
 		t.Errorf("Got bat value [%s]", v)
 	}
 }
+
+func TestEntry_EncodeCompressed(t *testing.T) {
+	e := entry{"key", strings.Repeat("value", 100)}
+	data, ok, err := e.encodeCompressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || len(data) >= len(e.Encode()) {
+		t.Fatalf("Value was not compressed")
+	}
+
+	read, size, err := readEntry(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != len(data) || read.key != e.key || read.value != e.value {
+		t.Errorf("Bad entry read back: size %d, key %s", size, read.key)
+	}
+
+	v, err := readValue(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != e.value {
+		t.Errorf("Got bad value [%s]", v)
+	}
+
+	if _, ok, _ := (&entry{"key", "short"}).encodeCompressed(); ok {
+		t.Errorf("Value that does not shrink was compressed")
+	}
+}
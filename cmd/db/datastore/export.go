@@ -0,0 +1,112 @@
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// record is a single line of the JSONL dump produced by Export and consumed by Import.
+type record struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Export writes the latest value of every key to w as newline-delimited JSON.
+// Segments are scanned from the newest to the oldest one and records that are
+// overwritten later are skipped, so values are streamed straight from disk
+// without collecting the keyspace in memory. The dump reflects the database
+// at the moment Export is called and does not block writes while w consumes it.
+func (db *Db) Export(w io.Writer) error {
+	segments, err := db.snapshot()
+	if err != nil {
+		return err
+	}
+	defer release(segments)
+
+	enc := json.NewEncoder(w)
+	for i := len(segments) - 1; i >= 0; i-- {
+		seg := segments[i]
+		newer := segments[i+1:]
+		_, err := seg.scan(func(e *entry, offset int64) error {
+			latest, err := seg.isLatest(e.key, offset)
+			if err != nil || !latest {
+				return err
+			}
+			if skip, err := shadowed(e.key, newer); err != nil || skip {
+				return err
+			}
+			return enc.Encode(record{Key: e.key, Value: e.value})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshot copies the segments under the read lock. The copies hold their
+// files open, so merges and removals do not affect them, and read only the
+// records written so far. The index of the active segment is copied as well
+// since writes keep changing it, sealed indexes are never modified.
+func (db *Db) snapshot() ([]*segment, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	segments := make([]*segment, 0, len(db.segments))
+	for _, seg := range db.segments {
+		file, err := os.Open(seg.filePath)
+		if err != nil {
+			release(segments)
+			return nil, err
+		}
+		idx := seg.index
+		if seg == db.tail() {
+			active := make(hashIndex, seg.index.size())
+			for key, offset := range seg.index.(hashIndex) {
+				active[key] = offset
+			}
+			idx = active
+		}
+		segments = append(segments, &segment{
+			filePath:  seg.filePath,
+			outOffset: seg.outOffset,
+			index:     idx,
+			frozen:    file,
+		})
+	}
+	return segments, nil
+}
+
+// release closes the files of snapshot segments.
+func release(segments []*segment) {
+	for _, seg := range segments {
+		_ = seg.frozen.Close()
+	}
+}
+
+// ErrMalformedRecord is returned by Import for input that is not a dump.
+var ErrMalformedRecord = fmt.Errorf("malformed record")
+
+// Import reads newline-delimited JSON records from r and puts each of them
+// into the database. It returns the number of records stored before the
+// first error, which wraps ErrMalformedRecord if the input is at fault.
+func (db *Db) Import(r io.Reader) (int, error) {
+	dec := json.NewDecoder(r)
+	count := 0
+	for {
+		var rec record
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, fmt.Errorf("%w %d: %s", ErrMalformedRecord, count+1, err)
+		}
+		if err := db.Put(rec.Key, rec.Value); err != nil {
+			return count, err
+		}
+		count++
+	}
+}
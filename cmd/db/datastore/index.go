@@ -0,0 +1,86 @@
+package datastore
+
+import "sort"
+
+// index maps keys to the offsets of their records inside a segment.
+type index interface {
+	put(key string, offset int64)
+	// lookup returns the candidate offsets for key, newest first. Candidates
+	// may belong to other keys, so callers have to check the stored key.
+	lookup(key string) []int64
+	size() int
+}
+
+type hashIndex map[string]int64
+
+func (hi hashIndex) put(key string, offset int64) {
+	hi[key] = offset
+}
+
+func (hi hashIndex) lookup(key string) []int64 {
+	if offset, ok := hi[key]; ok {
+		return []int64{offset}
+	}
+	return nil
+}
+
+func (hi hashIndex) size() int {
+	return len(hi)
+}
+
+type compactEntry struct {
+	hash   uint64
+	offset int64
+}
+
+// compactIndex stores a 64-bit key hash and an offset per record instead of
+// the keys themselves, which keeps it at 16 bytes per key. It is meant for
+// sealed segments only: records are appended with put and become visible to
+// lookup after seal sorts them.
+type compactIndex struct {
+	entries []compactEntry
+}
+
+func newCompactIndex(capacity int) *compactIndex {
+	return &compactIndex{entries: make([]compactEntry, 0, capacity)}
+}
+
+func (ci *compactIndex) put(key string, offset int64) {
+	ci.entries = append(ci.entries, compactEntry{hash: keyHash(key), offset: offset})
+}
+
+func (ci *compactIndex) seal() {
+	sort.Slice(ci.entries, func(i, j int) bool {
+		a, b := ci.entries[i], ci.entries[j]
+		if a.hash != b.hash {
+			return a.hash < b.hash
+		}
+		return a.offset > b.offset
+	})
+}
+
+func (ci *compactIndex) lookup(key string) []int64 {
+	hash := keyHash(key)
+	i := sort.Search(len(ci.entries), func(i int) bool {
+		return ci.entries[i].hash >= hash
+	})
+	var offsets []int64
+	for ; i < len(ci.entries) && ci.entries[i].hash == hash; i++ {
+		offsets = append(offsets, ci.entries[i].offset)
+	}
+	return offsets
+}
+
+func (ci *compactIndex) size() int {
+	return len(ci.entries)
+}
+
+// keyHash is a 64-bit FNV-1a hash of the key.
+func keyHash(key string) uint64 {
+	hash := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint64(key[i])
+		hash *= 1099511628211
+	}
+	return hash
+}
@@ -0,0 +1,161 @@
+package datastore
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCompactIndex_Lookup(t *testing.T) {
+	ci := newCompactIndex(0)
+	ci.put("key1", 0)
+	ci.put("key2", 20)
+	ci.put("key1", 40)
+	ci.seal()
+
+	if offsets := ci.lookup("key1"); !reflect.DeepEqual(offsets, []int64{40, 0}) {
+		t.Errorf("Unexpected offsets for key1: %v", offsets)
+	}
+	if offsets := ci.lookup("key2"); !reflect.DeepEqual(offsets, []int64{20}) {
+		t.Errorf("Unexpected offsets for key2: %v", offsets)
+	}
+	if offsets := ci.lookup("key3"); len(offsets) != 0 {
+		t.Errorf("Unexpected offsets for missing key: %v", offsets)
+	}
+	if ci.size() != 3 {
+		t.Errorf("Unexpected index size: %d", ci.size())
+	}
+}
+
+func heapAlloc() int64 {
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	return int64(stats.HeapAlloc)
+}
+
+// BenchmarkIndex_Heap reports how much heap a segment index holding a million keys retains.
+func BenchmarkIndex_Heap(b *testing.B) {
+	const keys = 1000000
+	builders := map[string]func() index{
+		"hash": func() index {
+			hi := make(hashIndex)
+			for i := 0; i < keys; i++ {
+				hi.put(fmt.Sprintf("key-%d", i), int64(i)*32)
+			}
+			return hi
+		},
+		"compact": func() index {
+			ci := newCompactIndex(keys)
+			for i := 0; i < keys; i++ {
+				ci.put(fmt.Sprintf("key-%d", i), int64(i)*32)
+			}
+			ci.seal()
+			return ci
+		},
+	}
+
+	for name, build := range builders {
+		build := build
+		b.Run(name, func(b *testing.B) {
+			var total int64
+			for i := 0; i < b.N; i++ {
+				before := heapAlloc()
+				idx := build()
+				total += heapAlloc() - before
+				runtime.KeepAlive(idx)
+			}
+			b.ReportMetric(float64(total)/float64(b.N), "heap-B/Mkeys")
+		})
+	}
+}
+
+// peakHeap samples the heap while fn runs and returns the largest size seen
+// above the heap before the call.
+func peakHeap(fn func()) int64 {
+	before := heapAlloc()
+	var peak int64
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		var stats runtime.MemStats
+		for {
+			runtime.ReadMemStats(&stats)
+			if heap := int64(stats.HeapAlloc); heap > atomic.LoadInt64(&peak) {
+				atomic.StoreInt64(&peak, heap)
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}()
+	fn()
+	close(done)
+	<-sampled
+	return atomic.LoadInt64(&peak) - before
+}
+
+// BenchmarkNewDb_Recovery reports the peak and retained heap of recovering a
+// database whose sealed segment holds a million keys.
+func BenchmarkNewDb_Recovery(b *testing.B) {
+	const keys = 1000000
+	dir, err := ioutil.TempDir("", "bench-db-recovery")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file, err := os.Create(filepath.Join(dir, segmentPrefix+"0"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	out := bufio.NewWriter(file)
+	for i := 0; i < keys; i++ {
+		e := entry{key: fmt.Sprintf("key-%d", i), value: "value"}
+		if _, err := out.Write(e.Encode()); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := out.Flush(); err != nil {
+		b.Fatal(err)
+	}
+	_ = file.Close()
+	if err := ioutil.WriteFile(filepath.Join(dir, segmentPrefix+"1"), nil, 0o600); err != nil {
+		b.Fatal(err)
+	}
+
+	options := map[string][]Option{
+		"hash":    nil,
+		"compact": {WithCompactIndex()},
+	}
+	for name, opts := range options {
+		opts := opts
+		b.Run(name, func(b *testing.B) {
+			var peak, retained int64
+			for i := 0; i < b.N; i++ {
+				var db *Db
+				before := heapAlloc()
+				peak += peakHeap(func() {
+					db, err = NewDb(dir, DefaultSegment, 1, opts...)
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+				retained += heapAlloc() - before
+				_ = db.Close()
+			}
+			b.ReportMetric(float64(peak)/float64(b.N), "peak-heap-B/Mkeys")
+			b.ReportMetric(float64(retained)/float64(b.N), "heap-B/Mkeys")
+		})
+	}
+}
@@ -1,9 +1,9 @@
 package datastore
 
 import (
-	"fmt"
 	"log"
 	"sync"
+	"sync/atomic"
 )
 // atomic counter for checking number of active workers
 type safeCounter struct {
@@ -37,14 +37,40 @@ func (db *Db) Get(key string) (string, error) {
 		<- db.getChan
 	}()
 
-	for _, seg := range db.segments {
+	if db.cache != nil {
+		if value, ok := db.cache.get(key); ok {
+			return value, nil
+		}
+	}
+
+	for i := len(db.segments) - 1; i >= 0; i-- {
+		seg := db.segments[i]
+		if seg.bloom != nil {
+			atomic.AddUint64(&db.stats.bloomChecks, 1)
+			if !seg.bloom.mayContain(key) {
+				atomic.AddUint64(&db.stats.bloomSkips, 1)
+				continue
+			}
+		}
+
 		value, err := seg.get(key)
 		if err == nil {
+			// Still under the read lock, so a concurrent Put cannot invalidate
+			// the key before the value read from disk gets cached.
+			if db.cache != nil {
+				db.cache.add(key, value)
+			}
 			return value, err
 		}
+		if err != ErrNotFound {
+			return "", err
+		}
+		if seg.bloom != nil {
+			atomic.AddUint64(&db.stats.bloomFalsePositives, 1)
+		}
 	}
 
-	return "", fmt.Errorf("did't find any value at the key: %s", key)
+	return "", ErrNotFound
 }
 
 
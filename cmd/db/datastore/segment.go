@@ -2,26 +2,33 @@ package datastore
 
 import (
 	"bufio"
-	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"path"
 	"strings"
 )
 
-type hashIndex map[string]int64
-
 type segment struct {
 	filePath string
 	file *os.File
 	outOffset int64
-	index hashIndex
+	index index
+	bloom *bloomFilter
+	// compressAbove is the value size starting from which new records are
+	// compressed, 0 disables compression.
+	compressAbove int
+	// frozen is the file a snapshot copy of the segment reads from, see
+	// Db.snapshot. Only the records before outOffset are read from it.
+	frozen *os.File
 }
 
 const bufSize = 8192
 
-func initSegment(path string) (*segment, error){
+// initSegment opens the segment file at path and fills idx with its records.
+// A compactIndex is sealed once all of them are read.
+func initSegment(path string, idx index) (*segment, error){
 	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
 	if err != nil {
 		return nil, err
@@ -30,13 +37,16 @@ func initSegment(path string) (*segment, error){
 		filePath: path,
 		file: file,
 		outOffset: 0,
-		index: make(hashIndex),
+		index: idx,
 	}
 
 	err = seg.recover()
-	if err != nil && err != io.EOF {
+	if err != nil {
 		return nil, err
 	}
+	if ci, ok := idx.(*compactIndex); ok {
+		ci.seal()
+	}
 
 	return seg, nil
 }
@@ -47,29 +57,85 @@ func (seg *segment) close() error {
 }
 
 func (seg *segment) get(key string) (string, error) {
-	position, ok := seg.index[key]
-	if !ok {
-		return "", ErrNotFound
+	e, _, err := seg.find(key)
+	if err != nil {
+		return "", err
 	}
+	return e.value, nil
+}
 
-	file, err := os.Open(seg.filePath)
+// find returns the newest record stored for key together with its offset.
+func (seg *segment) find(key string) (*entry, int64, error) {
+	positions := seg.index.lookup(key)
+	if len(positions) == 0 {
+		return nil, 0, ErrNotFound
+	}
+
+	file, release, err := seg.open()
 	if err != nil {
-		return "", err
+		return nil, 0, err
+	}
+	defer release()
+
+	for _, position := range positions {
+		e, err := readAt(file, position)
+		if err != nil {
+			return nil, 0, err
+		}
+		if e.key == key {
+			return e, position, nil
+		}
 	}
-	defer file.Close()
+	return nil, 0, ErrNotFound
+}
+
+// isLatest reports whether the record at offset is the newest one for key in the segment.
+func (seg *segment) isLatest(key string, offset int64) (bool, error) {
+	for _, position := range seg.index.lookup(key) {
+		if position == offset {
+			return true, nil
+		}
+		if position < offset {
+			break
+		}
+		e, err := seg.readAt(position)
+		if err != nil {
+			return false, err
+		}
+		if e.key == key {
+			return false, nil
+		}
+	}
+	return false, nil
+}
 
-	_, err = file.Seek(position, 0)
+func (seg *segment) readAt(offset int64) (*entry, error) {
+	file, release, err := seg.open()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	defer release()
+	return readAt(file, offset)
+}
 
-	reader := bufio.NewReader(file)
-	value, err := readValue(reader)
+// open returns the segment file for reading and a function releasing it.
+// Snapshot copies return the file they hold.
+func (seg *segment) open() (*os.File, func(), error) {
+	if seg.frozen != nil {
+		return seg.frozen, func() {}, nil
+	}
+	file, err := os.Open(seg.filePath)
 	if err != nil {
-		return "", nil
+		return nil, nil, err
 	}
+	return file, func() { _ = file.Close() }, nil
+}
 
-	return value, nil
+// readAt reads the record at offset without moving the file offset, so a
+// file shared by a snapshot can be read while it is being scanned.
+func readAt(file *os.File, offset int64) (*entry, error) {
+	e, _, err := readEntry(bufio.NewReader(io.NewSectionReader(file, offset, math.MaxInt64-offset)))
+	return e, err
 }
 
 func (seg *segment) put(key, value string) error {
@@ -77,9 +143,20 @@ func (seg *segment) put(key, value string) error {
 		key:   key,
 		value: value,
 	}
-	n, err := seg.file.Write(e.Encode())
+	data := e.Encode()
+	if seg.compressAbove > 0 && len(value) >= seg.compressAbove {
+		compressed, ok, err := e.encodeCompressed()
+		if err != nil {
+			return err
+		}
+		if ok {
+			data = compressed
+		}
+	}
+
+	n, err := seg.file.Write(data)
 	if err == nil {
-		seg.index[key] = seg.outOffset
+		seg.index.put(key, seg.outOffset)
 		seg.outOffset += int64(n)
 	}
 	return err
@@ -94,46 +171,81 @@ func (seg *segment) checkHealth() error {
 }
 
 func (seg *segment) recover() error {
-	input, err := os.Open(seg.filePath)
-	if err != nil {
-		return err
+	end, err := seg.scan(func(e *entry, offset int64) error {
+		seg.index.put(e.key, offset)
+		return nil
+	})
+	seg.outOffset = end
+	return err
+}
+
+// compact replaces the in-memory hash index of a sealed segment with a compactIndex.
+func (seg *segment) compact() {
+	if _, ok := seg.index.(*compactIndex); ok {
+		return
 	}
-	defer input.Close()
+	compacted := newCompactIndex(seg.index.size())
+	for key, offset := range seg.index.(hashIndex) {
+		compacted.put(key, offset)
+	}
+	compacted.seal()
+	seg.index = compacted
+}
 
-	var buf [bufSize]byte
-	in := bufio.NewReaderSize(input, bufSize)
-	for err == nil {
-		var (
-			header, data []byte
-			n int
-		)
-		header, err = in.Peek(bufSize)
-		if err == io.EOF {
-			if len(header) == 0 {
-				return err
-			}
-		} else if err != nil {
+// loadBloom attaches the persisted Bloom filter of a sealed segment, building
+// and saving a new one when it is missing, stale or has another fpRate.
+func (seg *segment) loadBloom(fpRate float64) error {
+	path := seg.filePath + bloomSuffix
+	if bf, err := loadBloomFilter(path, seg.outOffset); err == nil && bf.fpRate == fpRate {
+		seg.bloom = bf
+		return nil
+	}
+
+	bf := newBloomFilter(seg.index.size(), fpRate)
+	if hi, ok := seg.index.(hashIndex); ok {
+		for key := range hi {
+			bf.add(key)
+		}
+	} else {
+		_, err := seg.scan(func(e *entry, _ int64) error {
+			bf.add(e.key)
+			return nil
+		})
+		if err != nil {
 			return err
 		}
-		size := binary.LittleEndian.Uint32(header)
+	}
+	seg.bloom = bf
+	return bf.save(path, seg.outOffset)
+}
 
-		if size < bufSize {
-			data = buf[:size]
-		} else {
-			data = make([]byte, size)
-		}
-		n, err = in.Read(data)
+// scan reads the segment file sequentially and calls fn for every record in it.
+// It returns the offset right after the last record read.
+func (seg *segment) scan(fn func(e *entry, offset int64) error) (int64, error) {
+	file, release, err := seg.open()
+	if err != nil {
+		return 0, err
+	}
+	defer release()
 
-		if err == nil {
-			if n != int(size) {
-				return fmt.Errorf("corrupted file")
-			}
+	var input io.Reader = file
+	if seg.frozen != nil {
+		input = io.NewSectionReader(file, 0, seg.outOffset)
+	}
 
-			var e entry
-			e.Decode(data)
-			seg.index[e.key] = seg.outOffset
-			seg.outOffset += int64(n)
+	var offset int64
+	in := bufio.NewReaderSize(input, bufSize)
+	for {
+		e, n, err := readEntry(in)
+		if err == io.EOF {
+			return offset, nil
 		}
+		if err != nil {
+			return offset, err
+		}
+		if err := fn(e, offset); err != nil {
+			return offset, err
+		}
+		offset += int64(n)
 	}
-	return err
 }
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ReallyGreatBand/lab2.2/tracing"
+)
+
+var accessLogPath = flag.String("access-log", "", "file JSON access logs are appended to, - for stdout, empty to disable them")
+
+// accessEntry is a line of the access log.
+type accessEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestId"`
+	TraceID   string    `json:"traceId"`
+	Remote    string    `json:"remote"`
+	Method    string    `json:"method"`
+	Host      string    `json:"host"`
+	URI       string    `json:"uri"`
+	Pool      string    `json:"pool"`
+	Backend   string    `json:"backend,omitempty"`
+	Attempts  int       `json:"attempts"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	LatencyMs float64   `json:"latencyMs"`
+}
+
+// accessLog writes an entry per request as a JSON line. A nil accessLog discards them.
+type accessLog struct {
+	mutex   *sync.Mutex
+	encoder *json.Encoder
+}
+
+func openAccessLog(path string) (*accessLog, error) {
+	var out io.Writer
+	switch path {
+	case "":
+		return nil, nil
+	case "-":
+		out = os.Stdout
+	default:
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		out = file
+	}
+	return newAccessLog(out), nil
+}
+
+func newAccessLog(out io.Writer) *accessLog {
+	return &accessLog{mutex: new(sync.Mutex), encoder: json.NewEncoder(out)}
+}
+
+func (al *accessLog) write(r *http.Request, rec *responseRecorder, pool string, started time.Time) {
+	if al == nil {
+		return
+	}
+	trace, _ := tracing.FromContext(r.Context())
+	entry := accessEntry{
+		Time:      started.UTC(),
+		RequestID: trace.RequestID,
+		TraceID:   trace.TraceID,
+		Remote:    r.RemoteAddr,
+		Method:    r.Method,
+		Host:      r.Host,
+		URI:       r.RequestURI,
+		Pool:      pool,
+		Backend:   rec.backend,
+		Attempts:  rec.attempts,
+		Status:    rec.status,
+		Bytes:     rec.bytes,
+		LatencyMs: float64(time.Since(started)) / float64(time.Millisecond),
+	}
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+	if err := al.encoder.Encode(entry); err != nil {
+		log.Printf("Failed to write access log: %s", err)
+	}
+}
+
+// responseRecorder remembers what was sent to the client for the access log.
+type responseRecorder struct {
+	http.ResponseWriter
+	status  int
+	bytes   int64
+	backend string
+	// attempts is the number of backends the request was sent to.
+	attempts int
+}
+
+func newResponseRecorder(rw http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{ResponseWriter: rw}
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(p)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+func (rec *responseRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (rec *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection cannot be hijacked")
+	}
+	rec.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
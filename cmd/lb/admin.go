@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const adminTokenEnv = "LB_ADMIN_TOKEN"
+
+var (
+	adminPort      = flag.Int("admin-port", 0, "port of the admin API, which needs a token, 0 disables it")
+	adminHost      = flag.String("admin-host", "localhost", "address the admin API listens on")
+	adminTokenFlag = flag.String("admin-token", "",
+		"bearer token required by the admin API, overrides the "+adminTokenEnv+" environment variable")
+)
+
+func adminToken() string {
+	if *adminTokenFlag != "" {
+		return *adminTokenFlag
+	}
+	return os.Getenv(adminTokenEnv)
+}
+
+type backendStatus struct {
+	Host        string `json:"host"`
+	Weight      int    `json:"weight"`
+	Connections int    `json:"connections"`
+	Healthy     bool   `json:"healthy"`
+	Disabled    bool   `json:"disabled"`
+	Draining    bool   `json:"draining"`
+	// DrainDeadline is when a draining backend is removed at the latest.
+	DrainDeadline *time.Time `json:"drainDeadline,omitempty"`
+	Breaker       string     `json:"breaker"`
+	Failures      int        `json:"failures"`
+	LatencyMs     float64    `json:"latencyMs"`
+	EWMAMs        float64    `json:"ewmaMs"`
+}
+
+func (s *server) statusLocked() backendStatus {
+	status := backendStatus{
+		Host:        s.host,
+		Weight:      s.weight,
+		Connections: s.counter,
+		Healthy:     s.status,
+		Disabled:    s.disabled,
+		Draining:    s.draining,
+		Breaker:     s.breaker.state.String(),
+		Failures:    s.breaker.failures,
+		LatencyMs:   float64(s.latency.Microseconds()) / 1000,
+		EWMAMs:      float64(s.ewma.duration().Microseconds()) / 1000,
+	}
+	if s.draining && !s.drainDeadline.IsZero() {
+		deadline := s.drainDeadline
+		status.DrainDeadline = &deadline
+	}
+	return status
+}
+
+// status returns a snapshot of the pool state.
+func (sp *serverPool) status() []backendStatus {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+
+	statuses := make([]backendStatus, len(sp.servers))
+	for i, server := range sp.servers {
+		statuses[i] = server.statusLocked()
+	}
+	return statuses
+}
+
+// add puts a new server into the pool.
+func (sp *serverPool) add(b backend) (*server, error) {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	for _, server := range sp.servers {
+		if server.host == b.Host {
+			return nil, fmt.Errorf("backend %s already exists", b.Host)
+		}
+	}
+	server := newServer(b)
+	server.recovered = time.Now()
+	sp.servers = append(sp.servers, server)
+	return server, nil
+}
+
+func (sp *serverPool) find(host string) (*server, error) {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	for _, server := range sp.servers {
+		if server.host == host {
+			return server, nil
+		}
+	}
+	return nil, fmt.Errorf("backend %s does not exist", host)
+}
+
+// remove takes the server with host out of the pool right away.
+func (sp *serverPool) remove(host string) (*server, error) {
+	server, err := sp.find(host)
+	if err != nil {
+		return nil, err
+	}
+	sp.mutex.Lock()
+	sp.removeLocked(server)
+	sp.mutex.Unlock()
+	return server, nil
+}
+
+// modify applies change to the server with host under the pool mutex.
+func (sp *serverPool) modify(host string, change func(s *server)) (backendStatus, error) {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	for _, server := range sp.servers {
+		if server.host == host {
+			change(server)
+			return server.statusLocked(), nil
+		}
+	}
+	return backendStatus{}, fmt.Errorf("backend %s does not exist", host)
+}
+
+var adminActions = map[string]func(s *server){
+	"disable": func(s *server) {
+		s.disabled = true
+	},
+	"enable": func(s *server) {
+		s.disabled = false
+		s.draining = false
+	},
+}
+
+// adminHandler serves the admin API:
+//
+//	GET    /backends              lists the backends
+//	POST   /backends              adds a backend described by a JSON config entry
+//	DELETE /backends/<host>       drains and removes a backend, at once with ?force=true
+//	POST   /backends/<host>/drain drains and removes a backend
+//	POST   /backends/<host>/<op>  disables or enables a backend
+//	GET    /ratelimits            lists the rate limiters with their counters
+//
+// Enabling a draining backend cancels its removal.
+func adminHandler(pool *serverPool, checks *healthChecks, limits *rateLimits, token string, drainTimeout time.Duration) http.Handler {
+	h := new(http.ServeMux)
+
+	h.HandleFunc("/ratelimits", func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(rw, http.StatusOK, limits.status())
+	})
+
+	h.HandleFunc("/backends", func(rw http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(rw, http.StatusOK, pool.status())
+		case http.MethodPost:
+			var b backend
+			if err := json.NewDecoder(r.Body).Decode(&b); err != nil || b.Host == "" {
+				writeError(rw, http.StatusBadRequest, fmt.Errorf("expected a backend with a host"))
+				return
+			}
+			server, err := pool.add(b)
+			if err != nil {
+				writeError(rw, http.StatusConflict, err)
+				return
+			}
+			checks.start(server)
+			log.Printf("Backend %s added", b.Host)
+			writeJSON(rw, http.StatusCreated, pool.status())
+		default:
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+
+	h.HandleFunc("/backends/", func(rw http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/backends/"), "/")
+		host := parts[0]
+		switch {
+		case len(parts) == 1 && r.Method == http.MethodDelete && r.URL.Query().Get("force") == "true":
+			server, err := pool.remove(host)
+			if err != nil {
+				writeError(rw, http.StatusNotFound, err)
+				return
+			}
+			checks.stop(server)
+			log.Printf("Backend %s removed", host)
+			writeJSON(rw, http.StatusOK, pool.status())
+		case (len(parts) == 1 && r.Method == http.MethodDelete) ||
+			(len(parts) == 2 && r.Method == http.MethodPost && parts[1] == "drain"):
+			target, err := pool.find(host)
+			if err != nil {
+				writeError(rw, http.StatusNotFound, err)
+				return
+			}
+			pool.drain(target, drainTimeout, checks.stop)
+			status, _ := pool.modify(host, func(*server) {})
+			writeJSON(rw, http.StatusAccepted, status)
+		case len(parts) == 2 && r.Method == http.MethodPost && adminActions[parts[1]] != nil:
+			status, err := pool.modify(host, adminActions[parts[1]])
+			if err != nil {
+				writeError(rw, http.StatusNotFound, err)
+				return
+			}
+			log.Printf("Backend %s: %s", host, parts[1])
+			writeJSON(rw, http.StatusOK, status)
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	return authorize(token, h)
+}
+
+// authorize lets only requests with the bearer token through. Without a
+// token configured nothing is allowed.
+func authorize(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			writeError(rw, http.StatusForbidden, fmt.Errorf("admin token is not configured"))
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			writeError(rw, http.StatusUnauthorized, fmt.Errorf("bad admin token"))
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+func writeJSON(rw http.ResponseWriter, status int, value interface{}) {
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(value)
+}
+
+func writeError(rw http.ResponseWriter, status int, err error) {
+	writeJSON(rw, status, struct {
+		Error string `json:"error"`
+	}{
+		Error: err.Error(),
+	})
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	gocheck "gopkg.in/check.v1"
+)
+
+type MySuiteAdmin struct{}
+
+var _ = gocheck.Suite(&MySuiteAdmin{})
+
+func adminRequest(h http.Handler, method, path, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func (s *MySuiteAdmin) TestAuthorization(c *gocheck.C) {
+	pool := &serverPool{servers: mockServers(1), mutex: new(sync.Mutex), balancer: &leastConnections{}}
+
+	unconfigured := adminHandler(pool, newHealthChecks(pool), nil, "", time.Second)
+	c.Assert(adminRequest(unconfigured, "GET", "/backends", "", "").Code, gocheck.Equals, http.StatusForbidden)
+	c.Assert(adminRequest(unconfigured, "POST", "/backends/server1:8080/disable", "", "").Code, gocheck.Equals, http.StatusForbidden)
+
+	protected := adminHandler(pool, newHealthChecks(pool), nil, "secret", time.Second)
+	c.Assert(adminRequest(protected, "GET", "/backends", "", "").Code, gocheck.Equals, http.StatusUnauthorized)
+	c.Assert(adminRequest(protected, "GET", "/backends", "wrong", "").Code, gocheck.Equals, http.StatusUnauthorized)
+	c.Assert(adminRequest(protected, "GET", "/backends", "secret", "").Code, gocheck.Equals, http.StatusOK)
+}
+
+func (s *MySuiteAdmin) TestManageBackends(c *gocheck.C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	added := hostOf(ts).host
+
+	pool := &serverPool{servers: mockServers(1, 1), mutex: new(sync.Mutex), balancer: &leastConnections{}}
+	checks := newHealthChecks(pool)
+	h := adminHandler(pool, checks, nil, "secret", time.Second)
+	req := httptest.NewRequest("GET", "/", nil)
+
+	rec := adminRequest(h, "POST", "/backends/server1:8080/disable", "secret", "")
+	c.Assert(rec.Code, gocheck.Equals, http.StatusOK)
+	var status backendStatus
+	c.Assert(json.NewDecoder(rec.Body).Decode(&status), gocheck.IsNil)
+	c.Assert(status.Disabled, gocheck.Equals, true)
+	for i := 0; i < 3; i++ {
+		server, restore, _ := pool.acquire(req)
+		c.Assert(server.host, gocheck.Equals, "server2:8080")
+		restore()
+	}
+
+	c.Assert(adminRequest(h, "POST", "/backends/server1:8080/enable", "secret", "").Code, gocheck.Equals, http.StatusOK)
+	server, restore, _ := pool.acquire(req)
+	c.Assert(server.host, gocheck.Equals, "server1:8080")
+	restore()
+
+	c.Assert(adminRequest(h, "POST", "/backends/server9:8080/enable", "secret", "").Code, gocheck.Equals, http.StatusNotFound)
+	c.Assert(adminRequest(h, "POST", "/backends/server1:8080/explode", "secret", "").Code, gocheck.Equals, http.StatusNotFound)
+
+	rec = adminRequest(h, "POST", "/backends", "secret", `{"host": "`+added+`", "weight": 2}`)
+	c.Assert(rec.Code, gocheck.Equals, http.StatusCreated)
+	c.Assert(adminRequest(h, "POST", "/backends", "secret", `"`+added+`"`).Code, gocheck.Equals, http.StatusConflict)
+	c.Assert(adminRequest(h, "POST", "/backends", "secret", `{}`).Code, gocheck.Equals, http.StatusBadRequest)
+
+	c.Assert(adminRequest(h, "DELETE", "/backends/"+added+"?force=true", "secret", "").Code, gocheck.Equals, http.StatusOK)
+	c.Assert(adminRequest(h, "DELETE", "/backends/"+added+"?force=true", "secret", "").Code, gocheck.Equals, http.StatusNotFound)
+	c.Assert(pool.status(), gocheck.HasLen, 2)
+}
+
+func (s *MySuiteAdmin) TestDrainBackend(c *gocheck.C) {
+	pool := &serverPool{servers: mockServers(1, 1), mutex: new(sync.Mutex), balancer: &leastConnections{}}
+	h := adminHandler(pool, newHealthChecks(pool), nil, "secret", time.Minute)
+	req := httptest.NewRequest("GET", "/", nil)
+
+	_, restore, _ := pool.acquire(req)
+	rec := adminRequest(h, "DELETE", "/backends/server1:8080", "secret", "")
+	c.Assert(rec.Code, gocheck.Equals, http.StatusAccepted)
+	var status backendStatus
+	c.Assert(json.NewDecoder(rec.Body).Decode(&status), gocheck.IsNil)
+	c.Assert(status.Draining, gocheck.Equals, true)
+	c.Assert(status.Connections, gocheck.Equals, 1)
+	c.Assert(status.DrainDeadline, gocheck.NotNil)
+
+	// The draining server gets no new requests but stays until its request is done.
+	for i := 0; i < 3; i++ {
+		server, restore, _ := pool.acquire(req)
+		c.Assert(server.host, gocheck.Equals, "server2:8080")
+		restore()
+	}
+	time.Sleep(3 * drainPoll)
+	c.Assert(pool.status(), gocheck.HasLen, 2)
+
+	restore()
+	waitRemoved(c, pool, 1)
+	c.Assert(pool.status()[0].Host, gocheck.Equals, "server2:8080")
+	c.Assert(adminRequest(h, "POST", "/backends/server1:8080/drain", "secret", "").Code, gocheck.Equals, http.StatusNotFound)
+}
+
+func (s *MySuiteAdmin) TestDrainDeadline(c *gocheck.C) {
+	pool := &serverPool{servers: mockServers(1, 1), mutex: new(sync.Mutex), balancer: &leastConnections{}}
+	busy, restore, _ := pool.acquire(httptest.NewRequest("GET", "/", nil))
+	defer restore()
+
+	drained := make(chan *server, 1)
+	pool.drain(busy, 2*drainPoll, func(s *server) { drained <- s })
+	select {
+	case s := <-drained:
+		c.Assert(s, gocheck.Equals, busy)
+	case <-time.After(5 * time.Second):
+		c.Fatal("draining did not finish after the deadline")
+	}
+	c.Assert(pool.status(), gocheck.HasLen, 1)
+}
+
+func (s *MySuiteAdmin) TestDrainCancelled(c *gocheck.C) {
+	pool := &serverPool{servers: mockServers(1, 1), mutex: new(sync.Mutex), balancer: &leastConnections{}}
+	h := adminHandler(pool, newHealthChecks(pool), nil, "secret", time.Minute)
+	_, restore, _ := pool.acquire(httptest.NewRequest("GET", "/", nil))
+
+	c.Assert(adminRequest(h, "POST", "/backends/server1:8080/drain", "secret", "").Code, gocheck.Equals, http.StatusAccepted)
+	c.Assert(adminRequest(h, "POST", "/backends/server1:8080/enable", "secret", "").Code, gocheck.Equals, http.StatusOK)
+	restore()
+	time.Sleep(3 * drainPoll)
+	c.Assert(pool.status(), gocheck.HasLen, 2)
+	c.Assert(pool.status()[0].Draining, gocheck.Equals, false)
+}
+
+func waitRemoved(c *gocheck.C, pool *serverPool, expected int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if len(pool.status()) == expected {
+			return
+		}
+		time.Sleep(drainPoll)
+	}
+	c.Fatalf("pool still has %d servers", len(pool.status()))
+}
@@ -4,9 +4,11 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"io"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
 	"sync"
 	"time"
 
@@ -16,79 +18,198 @@ import (
 
 var (
 	port = flag.Int("port", 8090, "load balancer port")
-	timeoutSec = flag.Int("timeout-sec", 3, "request timeout time in seconds")
-	https = flag.Bool("https", false, "whether backends support HTTPs")
+	timeoutSec = flag.Int("timeout-sec", 3, "timeout of a single attempt to reach a backend in seconds")
+	https = flag.Bool("https", false, "whether backends support HTTPs, see -upstream-ca for verifying them")
 
 	traceEnabled = flag.Bool("trace", false, "whether to include tracing information into responses")
 )
 
 type server struct {
 	host string
+	weight int
 	counter int
 	status bool
+	breaker circuitBreaker
+	health healthConfig
+	// disabled and draining servers get no new requests, see the admin API.
+	disabled bool
+	draining bool
+	drainDeadline time.Time
+	// latency is how long the last response took to arrive, ewma is its average.
+	latency time.Duration
+	ewma ewma
+	stats backendStats
+	// sent counts the requests forwarded to the server, see stamp.
+	sent uint64
+	// recovered is when the server came back or was added, see slow start.
+	recovered time.Time
+	// current is the smooth weighted round-robin state, see weightedRoundRobin.
+	current float64
 }
 
-type leastConnections struct {
+// available reports whether the server may receive new requests.
+func (s *server) available(now time.Time) bool {
+	return s.status && !s.disabled && !s.draining && s.breaker.available(now)
+}
+
+// serverPool keeps the backends together with the number of requests in
+// flight on each of them and hands them out according to its balancer.
+type serverPool struct {
 	servers []*server
 	mutex *sync.Mutex
+	balancer Balancer
 }
 
-func (lc *leastConnections) getLeastConnected() (*server, func(), error) {
-	var (
-		min = -1
-		index = 0
-	)
-	lc.mutex.Lock()
-	for i, server := range lc.servers {
-		if (min == -1 || server.counter < min) && server.status {
-			min = server.counter
-			index = i
+// acquire picks a healthy server for r other than the excluded ones and
+// counts the request on it until the returned restore callback is called.
+func (sp *serverPool) acquire(r *http.Request, exclude ...*server) (*server, func(), error) {
+	sp.mutex.Lock()
+	now := time.Now()
+	var candidates []*server
+	for _, server := range sp.servers {
+		if server.available(now) && !contains(exclude, server) {
+			candidates = append(candidates, server)
 		}
 	}
-	if !lc.servers[index].status {
-		lc.mutex.Unlock()
-		return lc.servers[index], func() {
-			lc.servers[index].counter--
-		}, fmt.Errorf("no servers online")
+	if len(candidates) == 0 {
+		sp.mutex.Unlock()
+		return nil, func() {}, fmt.Errorf("no servers online")
 	}
 
-	lc.servers[index].counter++
-	lc.mutex.Unlock()
-	return lc.servers[index], func() {
-		lc.mutex.Lock()
-		lc.servers[index].counter--
-		lc.mutex.Unlock()
+	// The restore callbacks keep the server itself rather than its index,
+	// since the pool may be reloaded while the request is in flight.
+	chosen := sp.balancer.Pick(candidates, r)
+	chosen.breaker.acquired(now)
+	chosen.counter++
+	sp.mutex.Unlock()
+	return chosen, func() {
+		sp.mutex.Lock()
+		chosen.counter--
+		sp.mutex.Unlock()
 	}, nil
 }
 
-func Initialize(hosts []string) (*leastConnections, error) {
-	if len(hosts) == 0 {
+// report records the outcome of a request forwarded to server for its
+// circuit breaker and metrics, along with the latency of its response if one
+// arrived.
+func (sp *serverPool) report(server *server, success bool, latency time.Duration) {
+	sp.mutex.Lock()
+	server.breaker.record(server.host, success, time.Now())
+	server.stats.requests++
+	if !success {
+		server.stats.errors++
+	}
+	if latency > 0 {
+		server.latency = latency
+		server.ewma.observe(latency, time.Now(), *ewmaDecay)
+		server.stats.latency.observe(latency)
+	}
+	sp.mutex.Unlock()
+}
+
+// abandon settles a request to server its client cancelled. Unlike report it
+// does not count as an outcome, see circuitBreaker.abandoned.
+func (sp *serverPool) abandon(server *server) {
+	sp.mutex.Lock()
+	server.breaker.abandoned()
+	sp.mutex.Unlock()
+}
+
+// sequence counts a request about to be forwarded to server and returns its number.
+func (sp *serverPool) sequence(server *server) uint64 {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	server.sent++
+	return server.sent
+}
+
+// update replaces the pool with backends. Servers that stay in the pool keep
+// their counters and status, so in-flight requests are still accounted for.
+// Servers missing from backends are returned as removed: they stop receiving
+// requests but stay in the pool until drain takes them out.
+func (sp *serverPool) update(backends []backend) (added, removed []*server) {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+
+	existing := make(map[string]*server, len(sp.servers))
+	for _, s := range sp.servers {
+		existing[s.host] = s
+	}
+
+	servers := make([]*server, 0, len(backends))
+	for _, b := range backends {
+		s, ok := existing[b.Host]
+		if ok {
+			delete(existing, b.Host)
+			s.weight = b.weight()
+			s.health = b.Health
+			if s.draining {
+				log.Printf("Draining of %s cancelled, it is back in the config", s.host)
+				s.draining = false
+				s.drainDeadline = time.Time{}
+			}
+		} else {
+			s = newServer(b)
+			s.recovered = time.Now()
+			added = append(added, s)
+		}
+		servers = append(servers, s)
+	}
+	for _, s := range sp.servers {
+		if _, ok := existing[s.host]; ok {
+			if !s.draining {
+				s.draining = true
+				removed = append(removed, s)
+			}
+			servers = append(servers, s)
+		}
+	}
+
+	sp.servers = servers
+	return added, removed
+}
+
+func contains(servers []*server, s *server) bool {
+	for _, server := range servers {
+		if server == s {
+			return true
+		}
+	}
+	return false
+}
+
+func newServer(b backend) *server {
+	return &server{
+		host: b.Host,
+		weight: b.weight(),
+		counter: 0,
+		status: true,
+		health: b.Health,
+	}
+}
+
+func Initialize(backends []backend, balancer Balancer) (*serverPool, error) {
+	if len(backends) == 0 {
 		return nil, fmt.Errorf("no servers available")
 	}
 
-	servers := make([]*server, len(hosts))
+	servers := make([]*server, len(backends))
 	for index := range servers {
-		servers[index] = &server{
-			host: hosts[index],
-			counter: 0,
-			status: true,
-		}
+		servers[index] = newServer(backends[index])
 	}
 
-	return &leastConnections{
+	return &serverPool{
 		servers,
 		new(sync.Mutex),
+		balancer,
 	}, nil
 }
 
-var (
-	timeout        = time.Duration(*timeoutSec) * time.Second
-	serversPool, _ = Initialize([]string{
-		"server1:8080",
-		"server2:8080",
-		"server3:8080",
-	})
-)
+var serversPool *serverPool
+
+func timeout() time.Duration {
+	return time.Duration(*timeoutSec) * time.Second
+}
 
 func scheme() string {
 	if *https {
@@ -97,81 +218,141 @@ func scheme() string {
 	return "http"
 }
 
-func health(dst string) bool {
-	ctx, _ := context.WithTimeout(context.Background(), timeout)
-	req, _ := http.NewRequestWithContext(ctx, "GET",
-		fmt.Sprintf("%s://%s/health", scheme(), dst), nil)
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return false
+func main() {
+	flag.Parse()
+	if *instanceName == "" {
+		*instanceName, _ = os.Hostname()
 	}
-	if resp.StatusCode != http.StatusOK {
-		return false
+	// Health checks of every pool use the transport from their first check on.
+	err := configureUpstream()
+	if err != nil {
+		log.Fatalf("Failed to configure upstream TLS: %s", err)
 	}
-	return true
-}
 
-func forward(dst string, rw http.ResponseWriter, r *http.Request) {
-	ctx, _ := context.WithTimeout(r.Context(), timeout)
-	fwdRequest := r.Clone(ctx)
-	fwdRequest.RequestURI = ""
-	fwdRequest.URL.Host = dst
-	fwdRequest.URL.Scheme = scheme()
-	fwdRequest.Host = dst
-
-	resp, err := http.DefaultClient.Do(fwdRequest)
-	if err == nil {
-		for k, values := range resp.Header {
-			for _, value := range values {
-				rw.Header().Add(k, value)
-			}
+	if *discover != "" {
+		discovered, err = newDiscovery(*discover)
+		if err != nil {
+			log.Fatalf("Failed to configure discovery: %s", err)
 		}
-		if *traceEnabled {
-			rw.Header().Set("lb-from", dst)
+		ctx, cancel := context.WithTimeout(context.Background(), *discoverInterval)
+		_, err = discovered.refresh(ctx)
+		cancel()
+		if err != nil {
+			log.Fatalf("Failed to discover backends: %s", err)
 		}
-		log.Println("fwd", resp.StatusCode, resp.Request.URL)
-		rw.WriteHeader(resp.StatusCode)
-		defer resp.Body.Close()
-		_, err := io.Copy(rw, resp.Body)
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Failed to configure backends: %s", err)
+	}
+	var balancer Balancer
+	balancer, err = newBalancer(*strategy)
+	if err != nil {
+		log.Fatalf("Failed to configure balancing: %s", err)
+	}
+	var sessions *stickySessions
+	if *sticky != "" {
+		sessions, err = newStickySessions(*sticky, *stickyCookie, balancer)
 		if err != nil {
-			log.Printf("Failed to write response: %s", err)
+			log.Fatalf("Failed to configure session affinity: %s", err)
 		}
-	} else {
-		log.Printf("Failed to get response from %s: %s", dst, err)
-		rw.WriteHeader(http.StatusServiceUnavailable)
+		balancer = sessions
+	}
+	serversPool, err = Initialize(cfg.Backends, balancer)
+	if err != nil {
+		log.Fatalf("Failed to initialize backends: %s", err)
 	}
-}
-
-func main() {
-	flag.Parse()
 
-	// TODO: Використовуйте дані про стан сервреа, щоб підтримувати список тих серверів, яким можна відправляти запит.
+	checks := newHealthChecks(serversPool)
 	for _, server := range serversPool.servers {
-		server := server
-		go func() {
-			for range time.Tick(10 * time.Second) {
-				server.status = health(server.host)
-				log.Println(server.host, server.status, server.counter)
-			}
-		}()
+		checks.start(server)
+	}
+	routes, err := newRouter(cfg)
+	if err != nil {
+		log.Fatalf("Failed to initialize pools: %s", err)
 	}
 
-	frontend := httptools.CreateServer(*port, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		// TODO: Рееалізуйте свій алгоритм балансувальника.
+	reload := func() {
+		cfg, err := loadConfig()
+		if err != nil {
+			log.Printf("Failed to reload backends: %s", err)
+			return
+		}
+		added, removed := serversPool.update(cfg.Backends)
+		for _, server := range added {
+			checks.start(server)
+		}
+		for _, server := range removed {
+			serversPool.drain(server, *drainTimeout, checks.stop)
+		}
+		log.Printf("Backends reloaded: %d added, %d removed", len(added), len(removed))
+		if err := routes.update(cfg); err != nil {
+			log.Printf("Failed to reload pools: %s", err)
+		}
+	}
+	signal.NotifyReload(reload)
+	if *configPath != "" {
+		go watchConfig(*configPath, *configPoll, reload)
+	}
+	if discovered != nil {
+		go discovered.watch(*discoverInterval, reload)
+	}
 
-		server, restore, err := serversPool.getLeastConnected()
+	limits, err := newRateLimits(*rateLimit, *routeLimits, *rateLimitKey)
+	if err != nil {
+		log.Fatalf("Failed to configure rate limits: %s", err)
+	}
+	access, err := openAccessLog(*accessLogPath)
+	if err != nil {
+		log.Fatalf("Failed to open access log: %s", err)
+	}
+	handler := &frontend{
+		pool: serversPool,
+		sessions: sessions,
+		limits: limits,
+		router: routes,
+		access: access,
+		cache: newResponseCache(*cacheBytes, *cacheMaxEntry),
+	}
+	frontend := httptools.CreateServer(*port, handler)
+	if *tlsCert != "" {
+		certs, err := newCertStore(splitList(*tlsCert), splitList(*tlsKey))
 		if err != nil {
-			log.Println(err)
-			rw.WriteHeader(500)
-		} else {
-			log.Println(server)
-			forward(server.host, rw, r)
-			restore()
+			log.Fatalf("Failed to load certificates: %s", err)
+		}
+		reloadCerts := func() {
+			if err := certs.reload(); err != nil {
+				log.Printf("Failed to reload certificates: %s", err)
+				return
+			}
+			log.Println("Certificates reloaded")
 		}
-	}))
+		signal.NotifyReload(reloadCerts)
+		for _, file := range append(certs.certFiles, certs.keyFiles...) {
+			go watchConfig(file, *tlsPoll, reloadCerts)
+		}
+		frontend = httptools.CreateTLSServer(*port, handler, certs.tlsConfig())
+	}
+
+	if *adminPort > 0 {
+		if adminToken() == "" {
+			log.Fatalf("The admin API needs a token, see -admin-token or %s", adminTokenEnv)
+		}
+		admin := http.NewServeMux()
+		admin.Handle("/", adminHandler(serversPool, checks, limits, adminToken(), *drainTimeout))
+		admin.Handle("/metrics", authorize(adminToken(), metricsHandler(serversPool, routes, limits, handler.cache)))
+		httptools.CreateServerAt(net.JoinHostPort(*adminHost, strconv.Itoa(*adminPort)), admin).Start()
+	}
 
 	log.Println("Starting load balancer...")
+	log.Printf("Balancing strategy: %s", *strategy)
+	if discovered != nil {
+		log.Printf("Backends discovered at %s every %s", *discover, *discoverInterval)
+	}
+	log.Printf("Routes: %d to %d named pools", len(cfg.Routes), len(cfg.Pools))
 	log.Printf("Tracing support enabled: %t", *traceEnabled)
+	log.Printf("TLS termination enabled: %t", *tlsCert != "")
+	log.Printf("Response cache budget: %d bytes", *cacheBytes)
 	frontend.Start()
 	signal.WaitForTerminationSignal()
 }
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"fmt"
+	"math/rand"
+	"net/http/httptest"
 	"sync"
 	"testing"
+	"time"
 	gocheck "gopkg.in/check.v1"
 )
 
@@ -13,45 +17,51 @@ type MySuiteBalancer struct{}
 var _ = gocheck.Suite(&MySuiteBalancer{})
 
 func (s *MySuiteBalancer) TestBalancerInitialization(c *gocheck.C) {
-	mockServers   := []string{
-		"server1:8080",
-		"server2:8080",
-		"server3:8080",
+	mockServers   := []backend{
+		{Host: "server1:8080"},
+		{Host: "server2:8080"},
+		{Host: "server3:8080", Weight: 2},
 	}
-	initialized, _ := Initialize(mockServers)
+	balancer := &leastConnections{}
+	initialized, _ := Initialize(mockServers, balancer)
 
-	c.Assert(initialized, gocheck.DeepEquals, &leastConnections{
+	c.Assert(initialized, gocheck.DeepEquals, &serverPool{
 		servers: []*server{
-			{host: "server1:8080", counter: 0, status: true},
-			{host: "server2:8080", counter: 0, status: true},
-			{host: "server3:8080", counter: 0, status: true},
+			{host: "server1:8080", weight: 1, counter: 0, status: true},
+			{host: "server2:8080", weight: 1, counter: 0, status: true},
+			{host: "server3:8080", weight: 2, counter: 0, status: true},
 		},
 		mutex: new(sync.Mutex),
+		balancer: balancer,
 	})
 }
 
 func (s *MySuiteBalancer) TestBalancing(c *gocheck.C) {
-	mockLeastConnections := &leastConnections{
+	mockLeastConnections := &serverPool{
 		servers: []*server{
-			{host: "server1:8080", counter: 3, status: true},
-			{host: "server2:8080", counter: 2, status: true},
-			{host: "server3:8080", counter: 6, status: true},
+			{host: "server1:8080", weight: 1, counter: 3, status: true},
+			{host: "server2:8080", weight: 1, counter: 2, status: true},
+			{host: "server3:8080", weight: 1, counter: 6, status: true},
 		},
 		mutex: new(sync.Mutex),
+		balancer: &leastConnections{},
 	}
+	req := httptest.NewRequest("GET", "/", nil)
 
-	server2, restore2, _ := mockLeastConnections.getLeastConnected()
+	server2, restore2, _ := mockLeastConnections.acquire(req)
 
 	c.Assert(server2, gocheck.DeepEquals, &server{
 		host: "server2:8080",
+		weight: 1,
 		counter: 3,
 		status: true,
 	})
 
-	server1, restore1, _ := mockLeastConnections.getLeastConnected()
+	server1, restore1, _ := mockLeastConnections.acquire(req)
 
 	c.Assert(server1, gocheck.DeepEquals, &server{
 		host: "server1:8080",
+		weight: 1,
 		counter: 4,
 		status: true,
 	})
@@ -60,23 +70,242 @@ func (s *MySuiteBalancer) TestBalancing(c *gocheck.C) {
 
 	c.Assert(server2, gocheck.DeepEquals, &server{
 		host: "server2:8080",
+		weight: 1,
 		counter: 2,
 		status: true,
 	})
 
-	mockNoServers := &leastConnections{
+	mockNoServers := &serverPool{
 		servers: []*server{
 			{host: "server1:8080", counter: 3, status: false},
 			{host: "server2:8080", counter: 2, status: false},
 			{host: "server3:8080", counter: 6, status: false},
 		},
 		mutex: new(sync.Mutex),
+		balancer: &leastConnections{},
 	}
 
-	_, _, err := mockNoServers.getLeastConnected()
+	_, _, err := mockNoServers.acquire(req)
 
 	c.Assert(err, gocheck.ErrorMatches, "no servers online")
 
 	restore1()
 
 }
+
+func (s *MySuiteBalancer) TestPoolUpdate(c *gocheck.C) {
+	pool, _ := Initialize([]backend{{Host: "server1:8080"}, {Host: "server2:8080"}}, &leastConnections{})
+	req := httptest.NewRequest("GET", "/", nil)
+	server1, restore1, _ := pool.acquire(req)
+	c.Assert(server1.host, gocheck.Equals, "server1:8080")
+
+	added, removed := pool.update([]backend{{Host: "server1:8080", Weight: 3}, {Host: "server3:8080"}})
+
+	c.Assert(added, gocheck.HasLen, 1)
+	c.Assert(*added[0], gocheck.DeepEquals, server{
+		host: "server3:8080", weight: 1, counter: 0, status: true, recovered: added[0].recovered,
+	})
+	c.Assert(added[0].recovered.IsZero(), gocheck.Equals, false)
+	c.Assert(removed, gocheck.HasLen, 1)
+	c.Assert(removed[0].host, gocheck.Equals, "server2:8080")
+	c.Assert(pool.servers[0], gocheck.Equals, server1)
+	c.Assert(server1.counter, gocheck.Equals, 1)
+	c.Assert(server1.weight, gocheck.Equals, 3)
+
+	server3, restore3, _ := pool.acquire(req)
+	c.Assert(server3.host, gocheck.Equals, "server3:8080")
+
+	pool.update([]backend{{Host: "server1:8080"}})
+	restore3()
+	restore1()
+	c.Assert(server1.counter, gocheck.Equals, 0)
+	c.Assert(server3.counter, gocheck.Equals, 0)
+}
+
+func mockServers(weights ...int) []*server {
+	servers := make([]*server, len(weights))
+	for i, weight := range weights {
+		servers[i] = &server{host: fmt.Sprintf("server%d:8080", i+1), weight: weight, status: true}
+	}
+	return servers
+}
+
+// distribution counts how many of n picks each server gets.
+func distribution(b Balancer, servers []*server, n int, key func(i int) string) map[string]int {
+	picks := make(map[string]int)
+	for i := 0; i < n; i++ {
+		req := httptest.NewRequest("GET", "/api/v1/some-data?key="+key(i), nil)
+		picks[b.Pick(servers, req).host]++
+	}
+	return picks
+}
+
+func noKey(int) string { return "" }
+
+func (s *MySuiteBalancer) TestRoundRobin(c *gocheck.C) {
+	picks := distribution(&roundRobin{}, mockServers(1, 1, 1), 300, noKey)
+
+	c.Assert(picks, gocheck.DeepEquals, map[string]int{
+		"server1:8080": 100,
+		"server2:8080": 100,
+		"server3:8080": 100,
+	})
+}
+
+func (s *MySuiteBalancer) TestWeightedRoundRobin(c *gocheck.C) {
+	servers := mockServers(1, 2, 3)
+	wrr := &weightedRoundRobin{}
+
+	c.Assert(distribution(wrr, servers, 600, noKey), gocheck.DeepEquals, map[string]int{
+		"server1:8080": 100,
+		"server2:8080": 200,
+		"server3:8080": 300,
+	})
+
+	// Smooth balancing interleaves the picks: the heaviest server never gets
+	// more than two requests in a row with these weights.
+	var sequence []string
+	for i := 0; i < 12; i++ {
+		sequence = append(sequence, wrr.Pick(servers, nil).host)
+	}
+	for i := 2; i < len(sequence); i++ {
+		c.Assert(sequence[i] == sequence[i-1] && sequence[i] == sequence[i-2], gocheck.Equals, false)
+	}
+}
+
+func (s *MySuiteBalancer) TestLeastConnectionsStrategy(c *gocheck.C) {
+	servers := mockServers(1, 1, 1)
+	servers[0].counter, servers[1].counter, servers[2].counter = 4, 1, 3
+
+	c.Assert(distribution(&leastConnections{}, servers, 10, noKey), gocheck.DeepEquals, map[string]int{
+		"server2:8080": 10,
+	})
+}
+
+func (s *MySuiteBalancer) TestPowerOfTwo(c *gocheck.C) {
+	servers := mockServers(1, 1, 1)
+	servers[2].counter = 10
+	p2c := &powerOfTwo{rand: rand.New(rand.NewSource(1))}
+
+	picks := distribution(p2c, servers, 3000, noKey)
+
+	// The busiest server always loses the comparison, the others share the load.
+	c.Assert(picks["server3:8080"], gocheck.Equals, 0)
+	c.Assert(picks["server1:8080"] > 1200, gocheck.Equals, true)
+	c.Assert(picks["server2:8080"] > 1200, gocheck.Equals, true)
+}
+
+func (s *MySuiteBalancer) TestPeakEWMA(c *gocheck.C) {
+	servers := mockServers(1, 1, 1)
+	now := time.Now()
+	servers[0].ewma.observe(10*time.Millisecond, now, time.Second)
+	servers[1].ewma.observe(40*time.Millisecond, now, time.Second)
+
+	// Without observations a server is assumed as fast as the fastest one
+	// and is tried first.
+	c.Assert(distribution(&peakEWMA{}, servers, 10, noKey), gocheck.DeepEquals, map[string]int{
+		"server3:8080": 10,
+	})
+	servers[2].counter = 1
+	c.Assert(distribution(&peakEWMA{}, servers, 10, noKey), gocheck.DeepEquals, map[string]int{
+		"server1:8080": 10,
+	})
+
+	// Four requests in flight make the fast server worse than the slow idle one.
+	servers[0].counter, servers[2].counter = 4, 5
+	c.Assert(distribution(&peakEWMA{}, servers, 10, noKey), gocheck.DeepEquals, map[string]int{
+		"server2:8080": 10,
+	})
+}
+
+func (s *MySuiteBalancer) TestConsistentHash(c *gocheck.C) {
+	key, err := requestKey("query:key")
+	c.Assert(err, gocheck.IsNil)
+	ch := &consistentHash{key: key, fallback: &leastConnections{}}
+	servers := mockServers(1, 1, 1)
+	keyOf := func(i int) string { return fmt.Sprintf("key%d", i) }
+
+	picks := distribution(ch, servers, 3000, keyOf)
+	for _, server := range servers {
+		c.Assert(picks[server.host] > 800, gocheck.Equals, true, gocheck.Commentf("%v", picks))
+	}
+
+	// The same key always lands on the same server, and dropping a server
+	// only moves the keys that were mapped to it.
+	moved := 0
+	for i := 0; i < 3000; i++ {
+		req := httptest.NewRequest("GET", "/api/v1/some-data?key="+keyOf(i), nil)
+		before := ch.Pick(servers, req)
+		c.Assert(ch.Pick(servers, req), gocheck.Equals, before)
+		after := ch.Pick(servers[:2], req)
+		if after != before {
+			c.Assert(before, gocheck.Equals, servers[2])
+			moved++
+		}
+	}
+	c.Assert(moved, gocheck.Equals, picks["server3:8080"])
+
+	_, err = requestKey("cookie:session")
+	c.Assert(err, gocheck.NotNil)
+}
+
+func (s *MySuiteBalancer) TestStickyCookie(c *gocheck.C) {
+	sessions, err := newStickySessions("cookie", "lb-session", &roundRobin{})
+	c.Assert(err, gocheck.IsNil)
+	pool := &serverPool{
+		servers: mockServers(1, 1, 1),
+		mutex: new(sync.Mutex),
+		balancer: sessions,
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	pinned, restore, _ := pool.acquire(req)
+	restore()
+	rec := httptest.NewRecorder()
+	sessions.pin(rec, req, pinned)
+	cookies := rec.Result().Cookies()
+	c.Assert(cookies, gocheck.HasLen, 1)
+
+	req.AddCookie(cookies[0])
+	for i := 0; i < 5; i++ {
+		server, restore, _ := pool.acquire(req)
+		restore()
+		c.Assert(server, gocheck.Equals, pinned)
+	}
+	rec = httptest.NewRecorder()
+	sessions.pin(rec, req, pinned)
+	c.Assert(rec.Result().Cookies(), gocheck.HasLen, 0)
+
+	// Once the pinned server is down the client is moved and re-pinned.
+	pinned.status = false
+	server, restore, _ := pool.acquire(req)
+	restore()
+	c.Assert(server, gocheck.Not(gocheck.Equals), pinned)
+	rec = httptest.NewRecorder()
+	sessions.pin(rec, req, server)
+	c.Assert(rec.Result().Cookies()[0].Value, gocheck.Equals, serverID(server))
+}
+
+func (s *MySuiteBalancer) TestStickyHeader(c *gocheck.C) {
+	sessions, err := newStickySessions("header:X-User", "", &roundRobin{})
+	c.Assert(err, gocheck.IsNil)
+	servers := mockServers(1, 1, 1)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-User", "alice")
+	pinned := sessions.Pick(servers, req)
+	for i := 0; i < 5; i++ {
+		c.Assert(sessions.Pick(servers, req), gocheck.Equals, pinned)
+	}
+
+	var healthy []*server
+	for _, server := range servers {
+		if server != pinned {
+			healthy = append(healthy, server)
+		}
+	}
+	c.Assert(sessions.Pick(healthy, req), gocheck.Not(gocheck.Equals), pinned)
+
+	_, err = newStickySessions("header:", "", &roundRobin{})
+	c.Assert(err, gocheck.NotNil)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"time"
+)
+
+var (
+	breakerFailures = flag.Int("breaker-failures", 5,
+		"consecutive connection errors or 5xx responses that eject a backend, 0 disables the circuit breaker")
+	breakerCooldown = flag.Duration("breaker-cooldown", 10*time.Second,
+		"how long an ejected backend waits before a probe request is let through")
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (bs breakerState) String() string {
+	switch bs {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// circuitBreaker tracks the outcome of requests forwarded to a server. After
+// breakerFailures consecutive failures it opens and the server gets no
+// traffic for breakerCooldown, then a single probe request is let through
+// (half-open) and its outcome either closes or reopens the breaker. The zero
+// value is a closed breaker. It is guarded by the pool mutex.
+type circuitBreaker struct {
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// available reports whether the server may be picked for a request.
+func (cb *circuitBreaker) available(now time.Time) bool {
+	switch cb.state {
+	case breakerOpen:
+		return now.Sub(cb.openedAt) >= *breakerCooldown
+	case breakerHalfOpen:
+		return !cb.probing
+	}
+	return true
+}
+
+// acquired is called once the server is picked. A request to a server whose
+// cooldown has passed becomes the half-open probe.
+func (cb *circuitBreaker) acquired(now time.Time) {
+	if cb.state == breakerOpen && now.Sub(cb.openedAt) >= *breakerCooldown {
+		cb.state = breakerHalfOpen
+	}
+	if cb.state == breakerHalfOpen {
+		cb.probing = true
+	}
+}
+
+// abandoned is called when the client cancels a request to the server. That
+// says nothing about the server, but a probe has to end so that the next
+// request can probe again.
+func (cb *circuitBreaker) abandoned() {
+	cb.probing = false
+}
+
+func (cb *circuitBreaker) record(host string, success bool, now time.Time) {
+	if success {
+		if cb.state != breakerClosed {
+			log.Printf("Circuit breaker of %s is closed", host)
+		}
+		*cb = circuitBreaker{}
+		return
+	}
+
+	cb.failures++
+	if *breakerFailures <= 0 {
+		return
+	}
+	if cb.state == breakerHalfOpen || (cb.state == breakerClosed && cb.failures >= *breakerFailures) {
+		log.Printf("Circuit breaker of %s is open after %d failures", host, cb.failures)
+		cb.state = breakerOpen
+		cb.openedAt = now
+		cb.probing = false
+	}
+}
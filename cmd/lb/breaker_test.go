@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	gocheck "gopkg.in/check.v1"
+)
+
+type MySuiteBreaker struct{}
+
+var _ = gocheck.Suite(&MySuiteBreaker{})
+
+func (s *MySuiteBreaker) TestBreakerTransitions(c *gocheck.C) {
+	defer func(failures int, cooldown time.Duration) {
+		*breakerFailures, *breakerCooldown = failures, cooldown
+	}(*breakerFailures, *breakerCooldown)
+	*breakerFailures, *breakerCooldown = 3, time.Minute
+
+	var cb circuitBreaker
+	now := time.Now()
+	cb.record("server1:8080", false, now)
+	cb.record("server1:8080", false, now)
+	cb.record("server1:8080", true, now)
+	c.Assert(cb, gocheck.DeepEquals, circuitBreaker{})
+
+	for i := 0; i < 3; i++ {
+		c.Assert(cb.available(now), gocheck.Equals, true)
+		cb.record("server1:8080", false, now)
+	}
+	c.Assert(cb.state, gocheck.Equals, breakerOpen)
+	c.Assert(cb.available(now.Add(30*time.Second)), gocheck.Equals, false)
+
+	// After the cooldown exactly one probe is let through.
+	later := now.Add(time.Minute)
+	c.Assert(cb.available(later), gocheck.Equals, true)
+	cb.acquired(later)
+	c.Assert(cb.state, gocheck.Equals, breakerHalfOpen)
+	c.Assert(cb.available(later), gocheck.Equals, false)
+
+	// A failed probe reopens the breaker, a successful one closes it.
+	cb.record("server1:8080", false, later)
+	c.Assert(cb.state, gocheck.Equals, breakerOpen)
+	c.Assert(cb.available(later), gocheck.Equals, false)
+
+	latest := later.Add(time.Minute)
+	cb.acquired(latest)
+	cb.record("server1:8080", true, latest)
+	c.Assert(cb.state, gocheck.Equals, breakerClosed)
+	c.Assert(cb.available(latest), gocheck.Equals, true)
+}
+
+func (s *MySuiteBreaker) TestBreakerEjectsFailingBackend(c *gocheck.C) {
+	defer func(failures int) { *breakerFailures = failures }(*breakerFailures)
+	*breakerFailures = 2
+
+	failing := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer healthy.Close()
+
+	failingServer, healthyServer := hostOf(failing), hostOf(healthy)
+	healthyServer.counter = 1
+	f := testFrontend(failingServer, healthyServer)
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		c.Assert(rec.Code, gocheck.Equals, http.StatusInternalServerError)
+	}
+	c.Assert(failingServer.breaker.state, gocheck.Equals, breakerOpen)
+
+	rec := httptest.NewRecorder()
+	f.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	c.Assert(rec.Code, gocheck.Equals, http.StatusOK)
+
+	rec = adminRequest(adminHandler(f.pool, newHealthChecks(f.pool), nil, "secret", time.Second), "GET", "/backends", "secret", "")
+	var statuses []backendStatus
+	c.Assert(json.NewDecoder(rec.Body).Decode(&statuses), gocheck.IsNil)
+	c.Assert(statuses[0].Breaker, gocheck.Equals, "open")
+	c.Assert(statuses[0].Failures, gocheck.Equals, 2)
+	c.Assert(statuses[1].Breaker, gocheck.Equals, "closed")
+}
+
+func (s *MySuiteBreaker) TestCancelledProbe(c *gocheck.C) {
+	var cb circuitBreaker
+	now := time.Now()
+	cb.state, cb.openedAt = breakerOpen, now.Add(-*breakerCooldown)
+	cb.acquired(now)
+	c.Assert(cb.available(now), gocheck.Equals, false)
+
+	// A cancelled probe leaves the breaker half-open for the next probe.
+	cb.abandoned()
+	c.Assert(cb.state, gocheck.Equals, breakerHalfOpen)
+	c.Assert(cb.available(now), gocheck.Equals, true)
+
+	hang := make(chan bool, 1)
+	hang <- true
+	received := make(chan struct{}, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		if <-hang {
+			<-r.Context().Done()
+		}
+	}))
+	defer backend.Close()
+	server := hostOf(backend)
+	server.breaker = circuitBreaker{state: breakerOpen, openedAt: now.Add(-*breakerCooldown)}
+	f := testFrontend(server)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-received
+		cancel()
+	}()
+	f.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+	c.Assert(server.breaker.probing, gocheck.Equals, false)
+
+	hang <- false
+	rec := httptest.NewRecorder()
+	f.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	c.Assert(rec.Code, gocheck.Equals, http.StatusOK)
+	c.Assert(server.breaker.state, gocheck.Equals, breakerClosed)
+}
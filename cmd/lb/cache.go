@@ -0,0 +1,491 @@
+package main
+
+import (
+	"container/list"
+	"flag"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	cacheBytes    = flag.Int64("cache-bytes", 0, "size budget of the response cache in bytes, 0 disables it")
+	cacheMaxEntry = flag.Int64("cache-max-entry", 1<<20, "largest response body the cache keeps")
+)
+
+// cacheableStatus are the statuses whose responses may be stored.
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// cacheEntry is a stored response. It is never modified once stored, a
+// revalidated response replaces it.
+type cacheEntry struct {
+	key    string
+	status int
+	header http.Header
+	body   []byte
+	// vary holds the request values of the headers named by Vary.
+	vary     map[string]string
+	stored   time.Time
+	lifetime time.Duration
+	// age is the Age of the response when it was stored.
+	age time.Duration
+}
+
+func (e *cacheEntry) size() int64 {
+	size := int64(len(e.key) + len(e.body))
+	for name, values := range e.header {
+		for _, value := range values {
+			size += int64(len(name) + len(value))
+		}
+	}
+	return size
+}
+
+func (e *cacheEntry) currentAge(now time.Time) time.Duration {
+	return e.age + now.Sub(e.stored)
+}
+
+func (e *cacheEntry) fresh(now time.Time) bool {
+	return e.currentAge(now) < e.lifetime
+}
+
+// matches reports whether r selects the same variant as the request e was stored for.
+func (e *cacheEntry) matches(r *http.Request) bool {
+	for name, value := range e.vary {
+		if strings.Join(r.Header.Values(name), ",") != value {
+			return false
+		}
+	}
+	return true
+}
+
+// responseCache is an LRU cache of responses limited to budget bytes. It
+// stores only responses with explicit freshness information and serves
+// stale ones after revalidating them with the backend.
+type responseCache struct {
+	budget   int64
+	maxEntry int64
+
+	mutex         *sync.Mutex
+	size          int64
+	entries       map[string][]*list.Element
+	order         *list.List
+	hits          uint64
+	misses        uint64
+	revalidations uint64
+}
+
+func newResponseCache(budget, maxEntry int64) *responseCache {
+	if budget <= 0 {
+		return nil
+	}
+	return &responseCache{
+		budget:   budget,
+		maxEntry: maxEntry,
+		mutex:    new(sync.Mutex),
+		entries:  make(map[string][]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func cacheKey(r *http.Request) string {
+	return r.Host + r.URL.RequestURI()
+}
+
+// lookup returns the stored variant for r, if any.
+func (rc *responseCache) lookup(r *http.Request) *cacheEntry {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	for _, elem := range rc.entries[cacheKey(r)] {
+		if e := elem.Value.(*cacheEntry); e.matches(r) {
+			rc.order.MoveToFront(elem)
+			return e
+		}
+	}
+	return nil
+}
+
+func (rc *responseCache) store(e *cacheEntry) {
+	size := e.size()
+	if size > rc.budget {
+		return
+	}
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	for _, elem := range rc.entries[e.key] {
+		if old := elem.Value.(*cacheEntry); sameVariant(old.vary, e.vary) {
+			rc.removeLocked(elem)
+			break
+		}
+	}
+	rc.entries[e.key] = append(rc.entries[e.key], rc.order.PushFront(e))
+	rc.size += size
+	for rc.size > rc.budget {
+		rc.removeLocked(rc.order.Back())
+	}
+}
+
+func sameVariant(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, value := range a {
+		if other, ok := b[name]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (rc *responseCache) removeLocked(elem *list.Element) {
+	e := rc.order.Remove(elem).(*cacheEntry)
+	variants := rc.entries[e.key]
+	for i := range variants {
+		if variants[i] == elem {
+			variants = append(variants[:i], variants[i+1:]...)
+			break
+		}
+	}
+	if len(variants) == 0 {
+		delete(rc.entries, e.key)
+	} else {
+		rc.entries[e.key] = variants
+	}
+	rc.size -= e.size()
+}
+
+// record counts the result of a lookup: hit, miss or revalidated.
+func (rc *responseCache) record(result string) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	switch result {
+	case "hit":
+		rc.hits++
+	case "revalidated":
+		rc.revalidations++
+	default:
+		rc.misses++
+	}
+}
+
+// cacheStatus describes the cache in metrics.
+type cacheStatus struct {
+	Budget        int64
+	Size          int64
+	Entries       int
+	Hits          uint64
+	Misses        uint64
+	Revalidations uint64
+}
+
+func (rc *responseCache) status() cacheStatus {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	return cacheStatus{
+		Budget:        rc.budget,
+		Size:          rc.size,
+		Entries:       rc.order.Len(),
+		Hits:          rc.hits,
+		Misses:        rc.misses,
+		Revalidations: rc.revalidations,
+	}
+}
+
+// cacheControl parses a Cache-Control header into directives and their values.
+func cacheControl(h http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			name, arg := directive, ""
+			if i := strings.Index(directive, "="); i >= 0 {
+				name, arg = directive[:i], strings.Trim(directive[i+1:], `"`)
+			}
+			directives[strings.ToLower(name)] = arg
+		}
+	}
+	return directives
+}
+
+// usesCache reports whether r may be answered from the cache or stored in it.
+func usesCache(r *http.Request) bool {
+	if r.Method != http.MethodGet || r.Header.Get("Authorization") != "" {
+		return false
+	}
+	_, noStore := cacheControl(r.Header)["no-store"]
+	return !noStore
+}
+
+// needsRevalidation reports whether the client asks not to get a stored response unchecked.
+func needsRevalidation(r *http.Request) bool {
+	cc := cacheControl(r.Header)
+	_, noCache := cc["no-cache"]
+	return noCache || cc["max-age"] == "0"
+}
+
+// freshness returns how long a response may be served without revalidation
+// and whether it may be stored at all.
+func freshness(status int, h http.Header, now time.Time) (time.Duration, bool) {
+	if !cacheableStatus[status] || h.Get("Set-Cookie") != "" || h.Get("Trailer") != "" {
+		return 0, false
+	}
+	for _, name := range h.Values("Vary") {
+		if strings.TrimSpace(name) == "*" {
+			return 0, false
+		}
+	}
+	cc := cacheControl(h)
+	if _, ok := cc["no-store"]; ok {
+		return 0, false
+	}
+	if _, ok := cc["private"]; ok {
+		return 0, false
+	}
+	if _, ok := cc["no-cache"]; ok {
+		// Kept only to be revalidated on every request.
+		return 0, h.Get("ETag") != "" || h.Get("Last-Modified") != ""
+	}
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if arg, ok := cc[directive]; ok {
+			seconds, err := strconv.Atoi(arg)
+			if err != nil || seconds < 0 {
+				return 0, false
+			}
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+	if expires := h.Get("Expires"); expires != "" {
+		at, err := http.ParseTime(expires)
+		if err != nil {
+			return 0, true
+		}
+		date := now
+		if d, err := http.ParseTime(h.Get("Date")); err == nil {
+			date = d
+		}
+		if lifetime := at.Sub(date); lifetime > 0 {
+			return lifetime, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func varyValues(r *http.Request, h http.Header) map[string]string {
+	vary := make(map[string]string)
+	for _, value := range h.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = http.CanonicalHeaderKey(strings.TrimSpace(name)); name != "" {
+				vary[name] = strings.Join(r.Header.Values(name), ",")
+			}
+		}
+	}
+	return vary
+}
+
+// conditional returns r asking the backend to confirm that e is still valid.
+func conditional(r *http.Request, e *cacheEntry) *http.Request {
+	r = r.Clone(r.Context())
+	r.Header.Del("If-None-Match")
+	r.Header.Del("If-Modified-Since")
+	if etag := e.header.Get("ETag"); etag != "" {
+		r.Header.Set("If-None-Match", etag)
+	}
+	if modified := e.header.Get("Last-Modified"); modified != "" {
+		r.Header.Set("If-Modified-Since", modified)
+	}
+	return r
+}
+
+func hasValidator(e *cacheEntry) bool {
+	return e.header.Get("ETag") != "" || e.header.Get("Last-Modified") != ""
+}
+
+// notModified reports whether the conditional request r is satisfied by e.
+func notModified(r *http.Request, e *cacheEntry) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		etag := e.header.Get("ETag")
+		for _, candidate := range strings.Split(match, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || (etag != "" && candidate == strings.TrimPrefix(etag, "W/")) {
+				return true
+			}
+		}
+		return false
+	}
+	if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil {
+		if modified, err := http.ParseTime(e.header.Get("Last-Modified")); err == nil {
+			return !modified.After(since)
+		}
+	}
+	return false
+}
+
+// serve writes e to the client, as 304 if the client already has it.
+func (rc *responseCache) serve(rw http.ResponseWriter, r *http.Request, e *cacheEntry, result string) {
+	for name, values := range e.header {
+		rw.Header()[name] = append([]string(nil), values...)
+	}
+	rw.Header().Set("Age", strconv.Itoa(int(e.currentAge(time.Now()).Seconds())))
+	if *traceEnabled {
+		rw.Header().Set("lb-cache", result)
+	}
+	if notModified(r, e) {
+		rw.Header().Del("Content-Length")
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+	rw.Header().Set("Content-Length", strconv.Itoa(len(e.body)))
+	rw.WriteHeader(e.status)
+	_, _ = rw.Write(e.body)
+}
+
+// cacheWriter sits between the proxy and the client while a response comes
+// from a backend. It stores cacheable responses and, when a stale entry was
+// revalidated, answers the client from the cache instead of passing on 304.
+type cacheWriter struct {
+	client http.ResponseWriter
+	cache  *responseCache
+	r      *http.Request
+	stale  *cacheEntry
+
+	header      http.Header
+	wroteHeader bool
+	// served is set once the response came from the cache and backend writes are dropped.
+	served bool
+	entry  *cacheEntry
+	failed bool
+}
+
+func (rc *responseCache) writer(client http.ResponseWriter, r *http.Request, stale *cacheEntry) *cacheWriter {
+	return &cacheWriter{
+		client: client,
+		cache:  rc,
+		r:      r,
+		stale:  stale,
+		header: make(http.Header),
+	}
+}
+
+func (cw *cacheWriter) Header() http.Header {
+	if cw.wroteHeader {
+		return cw.client.Header()
+	}
+	return cw.header
+}
+
+func (cw *cacheWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	now := time.Now()
+
+	if status == http.StatusNotModified && cw.stale != nil {
+		refreshed := *cw.stale
+		refreshed.header = cw.stale.header.Clone()
+		for _, name := range []string{"Cache-Control", "Expires", "ETag", "Last-Modified", "Date"} {
+			if values := cw.header.Values(name); len(values) > 0 {
+				refreshed.header[name] = values
+			}
+		}
+		refreshed.stored, refreshed.age = now, 0
+		if lifetime, ok := freshness(refreshed.status, refreshed.header, now); ok {
+			refreshed.lifetime = lifetime
+			cw.cache.store(&refreshed)
+		}
+		cw.cache.record("revalidated")
+		cw.served = true
+		// The stored headers describe the entity, the ones set for this
+		// request alone, such as a session cookie, are added on top.
+		served := refreshed
+		served.header = refreshed.header.Clone()
+		for name, values := range cw.header {
+			if name == "Set-Cookie" || strings.HasPrefix(strings.ToLower(name), "lb-") {
+				served.header[name] = values
+			}
+		}
+		cw.cache.serve(cw.client, cw.r, &served, "revalidated")
+		return
+	}
+
+	cw.cache.record("miss")
+	for name, values := range cw.header {
+		for _, value := range values {
+			cw.client.Header().Add(name, value)
+		}
+	}
+	if *traceEnabled {
+		cw.client.Header().Set("lb-cache", "miss")
+	}
+	if lifetime, ok := freshness(status, cw.header, now); ok {
+		header := cw.header.Clone()
+		for name := range header {
+			if strings.HasPrefix(strings.ToLower(name), "lb-") {
+				header.Del(name)
+			}
+		}
+		cw.entry = &cacheEntry{
+			key:      cacheKey(cw.r),
+			status:   status,
+			header:   header,
+			vary:     varyValues(cw.r, header),
+			stored:   now,
+			lifetime: lifetime,
+		}
+		if age, err := strconv.Atoi(header.Get("Age")); err == nil && age > 0 {
+			cw.entry.age = time.Duration(age) * time.Second
+		}
+	}
+	cw.client.WriteHeader(status)
+}
+
+func (cw *cacheWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.served {
+		return len(p), nil
+	}
+	if cw.entry != nil {
+		if int64(len(cw.entry.body)+len(p)) > cw.cache.maxEntry {
+			cw.entry = nil
+		} else {
+			cw.entry.body = append(cw.entry.body, p...)
+		}
+	}
+	n, err := cw.client.Write(p)
+	if err != nil {
+		cw.failed = true
+	}
+	return n, err
+}
+
+func (cw *cacheWriter) Flush() {
+	if flusher, ok := cw.client.(http.Flusher); ok && !cw.served {
+		flusher.Flush()
+	}
+}
+
+// finish stores the response once it was passed on completely.
+func (cw *cacheWriter) finish(complete bool) {
+	if cw.entry == nil || !complete || cw.failed {
+		return
+	}
+	if length := cw.entry.header.Get("Content-Length"); length != "" && length != strconv.Itoa(len(cw.entry.body)) {
+		return
+	}
+	cw.cache.store(cw.entry)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	gocheck "gopkg.in/check.v1"
+)
+
+type MySuiteCache struct {
+	backends []*httptest.Server
+}
+
+var _ = gocheck.Suite(&MySuiteCache{})
+
+func (s *MySuiteCache) SetUpTest(c *gocheck.C) {
+	*traceEnabled = true
+}
+
+func (s *MySuiteCache) TearDownTest(c *gocheck.C) {
+	*traceEnabled = false
+	for _, backend := range s.backends {
+		backend.Close()
+	}
+	s.backends = nil
+}
+
+// cachedFrontend returns a frontend with a cache in front of handler and
+// the function returning the requests handler got.
+func (s *MySuiteCache) cachedFrontend(budget, maxEntry int64, handler http.HandlerFunc) (*frontend, func() []*http.Request) {
+	var (
+		mutex    sync.Mutex
+		received []*http.Request
+	)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		received = append(received, r)
+		mutex.Unlock()
+		handler(rw, r)
+	}))
+	s.backends = append(s.backends, backend)
+	f := testFrontend(hostOf(backend))
+	f.cache = newResponseCache(budget, maxEntry)
+	return f, func() []*http.Request {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return received
+	}
+}
+
+func get(f *frontend, url string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", url, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	f.ServeHTTP(rec, r)
+	return rec
+}
+
+func (s *MySuiteCache) TestFreshness(c *gocheck.C) {
+	now := time.Now()
+	for _, tc := range []struct {
+		status   int
+		header   map[string]string
+		lifetime time.Duration
+		ok       bool
+	}{
+		{200, map[string]string{"Cache-Control": "public, max-age=60"}, time.Minute, true},
+		{200, map[string]string{"Cache-Control": "max-age=60, s-maxage=10"}, 10 * time.Second, true},
+		{200, map[string]string{
+			"Expires": now.Add(time.Hour).UTC().Format(http.TimeFormat),
+			"Date":    now.UTC().Format(http.TimeFormat),
+		}, time.Hour, true},
+		{200, map[string]string{"Cache-Control": "no-cache", "ETag": `"v1"`}, 0, true},
+		{200, map[string]string{"Cache-Control": "no-cache"}, 0, false},
+		{200, map[string]string{"Cache-Control": "no-store, max-age=60"}, 0, false},
+		{200, map[string]string{"Cache-Control": "private, max-age=60"}, 0, false},
+		{200, map[string]string{"Cache-Control": "max-age=60", "Set-Cookie": "a=b"}, 0, false},
+		{200, map[string]string{"Cache-Control": "max-age=60", "Vary": "*"}, 0, false},
+		{200, map[string]string{"ETag": `"v1"`}, 0, false},
+		{500, map[string]string{"Cache-Control": "max-age=60"}, 0, false},
+	} {
+		h := make(http.Header)
+		for name, value := range tc.header {
+			h.Set(name, value)
+		}
+		lifetime, ok := freshness(tc.status, h, now)
+		c.Check(ok, gocheck.Equals, tc.ok, gocheck.Commentf("%v", tc.header))
+		if ok {
+			c.Check(lifetime.Round(time.Second), gocheck.Equals, tc.lifetime, gocheck.Commentf("%v", tc.header))
+		}
+	}
+}
+
+func (s *MySuiteCache) TestHit(c *gocheck.C) {
+	f, received := s.cachedFrontend(1<<20, 1<<20, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		_, _ = rw.Write([]byte("value of " + r.URL.Query().Get("key")))
+	})
+
+	first := get(f, "/api/v1/some-data?key=a")
+	c.Assert(first.Header().Get("lb-cache"), gocheck.Equals, "miss")
+	second := get(f, "/api/v1/some-data?key=a")
+	c.Assert(second.Header().Get("lb-cache"), gocheck.Equals, "hit")
+	c.Assert(second.Body.String(), gocheck.Equals, "value of a")
+	c.Assert(second.Header().Get("Age"), gocheck.Equals, "0")
+	c.Assert(second.Header().Get("X-Request-ID"), gocheck.Not(gocheck.Equals), first.Header().Get("X-Request-ID"))
+	c.Assert(received(), gocheck.HasLen, 1)
+
+	c.Assert(get(f, "/api/v1/some-data?key=b").Header().Get("lb-cache"), gocheck.Equals, "miss")
+	c.Assert(get(f, "/api/v1/some-data?key=a", "Cache-Control", "no-store").Header().Get("lb-cache"), gocheck.Equals, "")
+	c.Assert(get(f, "/api/v1/some-data?key=a", "Authorization", "Bearer x").Header().Get("lb-cache"), gocheck.Equals, "")
+	c.Assert(received(), gocheck.HasLen, 4)
+
+	status := f.cache.status()
+	c.Assert(status.Hits, gocheck.Equals, uint64(1))
+	c.Assert(status.Misses, gocheck.Equals, uint64(2))
+	c.Assert(status.Entries, gocheck.Equals, 2)
+}
+
+func (s *MySuiteCache) TestRevalidation(c *gocheck.C) {
+	f, received := s.cachedFrontend(1<<20, 1<<20, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=0")
+		rw.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = rw.Write([]byte("payload"))
+	})
+
+	c.Assert(get(f, "/data").Header().Get("lb-cache"), gocheck.Equals, "miss")
+	revalidated := get(f, "/data")
+	c.Assert(revalidated.Code, gocheck.Equals, http.StatusOK)
+	c.Assert(revalidated.Header().Get("lb-cache"), gocheck.Equals, "revalidated")
+	c.Assert(revalidated.Body.String(), gocheck.Equals, "payload")
+	c.Assert(received()[1].Header.Get("If-None-Match"), gocheck.Equals, `"v1"`)
+
+	// The client has the current version, so it gets a 304 too.
+	notModified := get(f, "/data", "If-None-Match", `"v1"`)
+	c.Assert(notModified.Code, gocheck.Equals, http.StatusNotModified)
+	c.Assert(notModified.Body.Len(), gocheck.Equals, 0)
+	c.Assert(f.cache.status().Revalidations, gocheck.Equals, uint64(2))
+}
+
+func (s *MySuiteCache) TestRevalidationKeepsRequestHeaders(c *gocheck.C) {
+	f, _ := s.cachedFrontend(1<<20, 1<<20, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=0")
+		rw.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = rw.Write([]byte("payload"))
+	})
+	sessions, err := newStickySessions("cookie", "lb-session", f.pool.balancer)
+	c.Assert(err, gocheck.IsNil)
+	f.sessions, f.pool.balancer = sessions, sessions
+
+	// A pinned client gets no cookie, so its response is stored; a new client
+	// has to be pinned even though its response is revalidated.
+	pinned := "lb-session=" + serverID(f.pool.servers[0])
+	c.Assert(get(f, "/data", "Cookie", pinned).Header().Get("lb-cache"), gocheck.Equals, "miss")
+	revalidated := get(f, "/data")
+	c.Assert(revalidated.Header().Get("lb-cache"), gocheck.Equals, "revalidated")
+	c.Assert(revalidated.Body.String(), gocheck.Equals, "payload")
+	c.Assert(revalidated.Header().Get("lb-attempts"), gocheck.Equals, "1")
+	c.Assert(revalidated.Header().Get("lb-from"), gocheck.Not(gocheck.Equals), "")
+	cookies := revalidated.Result().Cookies()
+	c.Assert(cookies, gocheck.HasLen, 1)
+	c.Assert(cookies[0].Name, gocheck.Equals, "lb-session")
+	c.Assert(cookies[0].Value, gocheck.Equals, serverID(f.pool.servers[0]))
+}
+
+func (s *MySuiteCache) TestVary(c *gocheck.C) {
+	f, received := s.cachedFrontend(1<<20, 1<<20, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Header().Set("Vary", "Accept-Language")
+		_, _ = rw.Write([]byte("lang " + r.Header.Get("Accept-Language")))
+	})
+
+	c.Assert(get(f, "/page", "Accept-Language", "uk").Body.String(), gocheck.Equals, "lang uk")
+	c.Assert(get(f, "/page", "Accept-Language", "en").Body.String(), gocheck.Equals, "lang en")
+	hit := get(f, "/page", "Accept-Language", "uk")
+	c.Assert(hit.Header().Get("lb-cache"), gocheck.Equals, "hit")
+	c.Assert(hit.Body.String(), gocheck.Equals, "lang uk")
+	c.Assert(received(), gocheck.HasLen, 2)
+}
+
+func (s *MySuiteCache) TestLimits(c *gocheck.C) {
+	f, _ := s.cachedFrontend(300, 100, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		_, _ = rw.Write([]byte(strings.Repeat("x", len(r.URL.Path)*10)))
+	})
+
+	get(f, "/big-enough-to-skip")
+	c.Assert(f.cache.status().Entries, gocheck.Equals, 0)
+
+	for _, path := range []string{"/a", "/b", "/c", "/d"} {
+		get(f, path)
+	}
+	status := f.cache.status()
+	c.Assert(status.Size <= status.Budget, gocheck.Equals, true)
+	c.Assert(status.Entries < 4, gocheck.Equals, true)
+	c.Assert(get(f, "/d").Header().Get("lb-cache"), gocheck.Equals, "hit")
+	c.Assert(get(f, "/a").Header().Get("lb-cache"), gocheck.Equals, "miss")
+}
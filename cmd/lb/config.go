@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const backendsEnv = "LB_BACKENDS"
+
+var (
+	backends   = flag.String("backends", "", "comma-separated backend hosts with optional =weight suffixes, overrides the "+backendsEnv+" environment variable")
+	configPath = flag.String("config", "", "JSON or, with a .yaml or .yml extension, YAML config file with the backend pools and routes, watched for changes and reloaded on SIGHUP")
+	configPoll = flag.Duration("config-poll", 5*time.Second, "how often the config file is checked for changes")
+
+	defaultBackends = []backend{
+		{Host: "server1:8080"},
+		{Host: "server2:8080"},
+		{Host: "server3:8080"},
+	}
+)
+
+type config struct {
+	// Backends form the default pool that gets the requests no route matches.
+	Backends []backend `json:"backends"`
+	// Health holds the health check settings shared by all backends.
+	Health healthConfig `json:"health"`
+	// Pools are the named pools routes send requests to.
+	Pools  map[string]poolConfig `json:"pools"`
+	Routes []route               `json:"routes"`
+}
+
+// poolConfig is a named pool with its own balancing strategy, the -strategy
+// flag by default, and health check settings overriding the shared ones.
+type poolConfig struct {
+	Backends []backend    `json:"backends"`
+	Strategy string       `json:"strategy"`
+	Health   healthConfig `json:"health"`
+}
+
+// backend is a config entry of the pool. In JSON it is either a plain host
+// string or an object with the host, its weight and health check settings.
+type backend struct {
+	Host   string       `json:"host"`
+	Weight int          `json:"weight"`
+	Health healthConfig `json:"health"`
+}
+
+func (b *backend) UnmarshalJSON(data []byte) error {
+	var host string
+	if err := json.Unmarshal(data, &host); err == nil {
+		*b = backend{Host: host}
+		return nil
+	}
+	type plain backend
+	return json.Unmarshal(data, (*plain)(b))
+}
+
+func (b backend) weight() int {
+	if b.Weight < 1 {
+		return 1
+	}
+	return b.Weight
+}
+
+// loadConfig reads the backend pool from the config file if one is set, then
+// from the -backends flag, then from the environment, falling back to the
+// docker-compose servers. Discovered backends replace the configured ones.
+func loadConfig() (*config, error) {
+	var err error
+	cfg := &config{}
+	switch {
+	case *configPath != "":
+		data, err := ioutil.ReadFile(*configPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := decodeConfig(*configPath, data, cfg); err != nil {
+			return nil, fmt.Errorf("cannot parse %s: %s", *configPath, err)
+		}
+	case *backends != "":
+		cfg.Backends, err = parseBackends(*backends)
+	case os.Getenv(backendsEnv) != "":
+		cfg.Backends, err = parseBackends(os.Getenv(backendsEnv))
+	default:
+		cfg.Backends = append([]backend(nil), defaultBackends...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if discovered != nil {
+		cfg.Backends = discovered.current()
+	}
+
+	if len(cfg.Backends) == 0 {
+		return nil, fmt.Errorf("no servers available")
+	}
+	for i := range cfg.Backends {
+		cfg.Backends[i].Health = cfg.Backends[i].Health.merge(cfg.Health)
+	}
+	for name, pool := range cfg.Pools {
+		if name == defaultPool {
+			return nil, fmt.Errorf("pool name %q is reserved for the top-level backends", name)
+		}
+		if len(pool.Backends) == 0 {
+			return nil, fmt.Errorf("pool %s has no servers", name)
+		}
+		for i := range pool.Backends {
+			pool.Backends[i].Health = pool.Backends[i].Health.merge(pool.Health).merge(cfg.Health)
+		}
+	}
+	for _, rt := range cfg.Routes {
+		if _, ok := cfg.Pools[rt.Pool]; !ok && rt.Pool != defaultPool {
+			return nil, fmt.Errorf("route to unknown pool %q", rt.Pool)
+		}
+	}
+	return cfg, nil
+}
+
+// decodeConfig parses data as YAML if path has a .yaml or .yml extension and
+// as JSON otherwise. YAML is converted to JSON first, so that both formats
+// have the same fields and the same shorthands, such as plain host strings.
+func decodeConfig(path string, data []byte, cfg *config) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		var doc interface{}
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return err
+		}
+		converted, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		data = converted
+	}
+	return json.Unmarshal(data, cfg)
+}
+
+// parseBackends parses a comma-separated list of hosts, each optionally
+// followed by =weight.
+func parseBackends(list string) ([]backend, error) {
+	var parsed []backend
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		b := backend{Host: item}
+		if i := strings.LastIndex(item, "="); i >= 0 {
+			weight, err := strconv.Atoi(item[i+1:])
+			if err != nil {
+				return nil, fmt.Errorf("bad weight of backend %s: %s", item, err)
+			}
+			b = backend{Host: item[:i], Weight: weight}
+		}
+		parsed = append(parsed, b)
+	}
+	return parsed, nil
+}
+
+// watchConfig calls reload whenever the modification time of the file at path changes.
+func watchConfig(path string, interval time.Duration, reload func()) {
+	var modTime time.Time
+	if info, err := os.Stat(path); err == nil {
+		modTime = info.ModTime()
+	}
+	for range time.Tick(interval) {
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Printf("Cannot stat config %s: %s", path, err)
+			continue
+		}
+		if !info.ModTime().Equal(modTime) {
+			modTime = info.ModTime()
+			reload()
+		}
+	}
+}
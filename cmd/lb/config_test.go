@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	gocheck "gopkg.in/check.v1"
+)
+
+type MySuiteConfig struct{}
+
+var _ = gocheck.Suite(&MySuiteConfig{})
+
+func (s *MySuiteConfig) TearDownTest(c *gocheck.C) {
+	*configPath = ""
+	*backends = ""
+	_ = os.Unsetenv(backendsEnv)
+}
+
+func (s *MySuiteConfig) TestLoadConfig(c *gocheck.C) {
+	cfg, err := loadConfig()
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(cfg.Backends, gocheck.DeepEquals, defaultBackends)
+
+	_ = os.Setenv(backendsEnv, "env1:8080,env2:8080")
+	cfg, err = loadConfig()
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(cfg.Backends, gocheck.DeepEquals, []backend{{Host: "env1:8080"}, {Host: "env2:8080"}})
+
+	*backends = " flag1:8080, ,flag2:8080=3 "
+	cfg, err = loadConfig()
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(cfg.Backends, gocheck.DeepEquals, []backend{{Host: "flag1:8080"}, {Host: "flag2:8080", Weight: 3}})
+
+	*backends = "flag1:8080=heavy"
+	_, err = loadConfig()
+	c.Assert(err, gocheck.ErrorMatches, "bad weight of backend .*")
+	*backends = ""
+
+	dir := c.MkDir()
+	*configPath = filepath.Join(dir, "lb.json")
+	c.Assert(ioutil.WriteFile(*configPath, []byte(`{"backends": ["file1:8080", {"host": "file2:8080", "weight": 2}]}`), 0o600), gocheck.IsNil)
+	cfg, err = loadConfig()
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(cfg.Backends, gocheck.DeepEquals, []backend{{Host: "file1:8080"}, {Host: "file2:8080", Weight: 2}})
+
+	c.Assert(ioutil.WriteFile(*configPath, []byte(`{"backends": []}`), 0o600), gocheck.IsNil)
+	_, err = loadConfig()
+	c.Assert(err, gocheck.ErrorMatches, "no servers available")
+}
+
+func (s *MySuiteConfig) TestLoadYAMLConfig(c *gocheck.C) {
+	*configPath = filepath.Join(c.MkDir(), "lb.yaml")
+	c.Assert(ioutil.WriteFile(*configPath, []byte(`
+backends:
+  - file1:8080
+  - host: file2:8080
+    weight: 2
+health:
+  interval: 2s
+pools:
+  api:
+    strategy: round-robin
+    backends: [api1:8080]
+routes:
+  - pathPrefix: /api/
+    pool: api
+`), 0o600), gocheck.IsNil)
+
+	cfg, err := loadConfig()
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(cfg.Backends, gocheck.HasLen, 2)
+	c.Assert(cfg.Backends[0].Host, gocheck.Equals, "file1:8080")
+	c.Assert(cfg.Backends[1].Weight, gocheck.Equals, 2)
+	c.Assert(cfg.Backends[1].Health.Interval, gocheck.Equals, duration(2*time.Second))
+	c.Assert(cfg.Pools["api"].Strategy, gocheck.Equals, "round-robin")
+	c.Assert(cfg.Pools["api"].Backends[0].Host, gocheck.Equals, "api1:8080")
+	c.Assert(cfg.Routes, gocheck.HasLen, 1)
+	c.Assert(cfg.Routes[0].PathPrefix, gocheck.Equals, "/api/")
+
+	c.Assert(ioutil.WriteFile(*configPath, []byte("backends: [file1:8080\n"), 0o600), gocheck.IsNil)
+	_, err = loadConfig()
+	c.Assert(err, gocheck.ErrorMatches, "cannot parse .*lb.yaml: .*")
+}
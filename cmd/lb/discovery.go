@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	discover = flag.String("discover", "",
+		"where the default pool is discovered, overriding the configured backends: dns:<name>:<port> for A records, "+
+			"srv:<name> for SRV records or file:<path> for a JSON registry of backends")
+	discoverInterval = flag.Duration("discover-interval", 10*time.Second, "how often backends are discovered again")
+)
+
+// resolver looks up the DNS records of discovered backends.
+type resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+var dnsResolver resolver = net.DefaultResolver
+
+// discovery keeps the backends found at its source the last time it was
+// refreshed, so that scaling the backends up or down reaches the pool.
+type discovery struct {
+	kind string
+	name string
+	port string
+
+	mutex    sync.Mutex
+	backends []backend
+}
+
+// discovered is the discovery of the default pool, nil when the pool is configured statically.
+var discovered *discovery
+
+func newDiscovery(spec string) (*discovery, error) {
+	kind := spec
+	var target string
+	if i := strings.Index(spec, ":"); i >= 0 {
+		kind, target = spec[:i], spec[i+1:]
+	}
+	d := &discovery{kind: kind, name: target}
+	switch kind {
+	case "dns":
+		host, port, err := net.SplitHostPort(target)
+		if err != nil || host == "" {
+			return nil, fmt.Errorf("bad DNS discovery %q, expected dns:<name>:<port>", spec)
+		}
+		if _, err := strconv.Atoi(port); err != nil {
+			return nil, fmt.Errorf("bad DNS discovery %q, expected dns:<name>:<port>", spec)
+		}
+		d.name, d.port = host, port
+	case "srv", "file":
+		if target == "" {
+			return nil, fmt.Errorf("bad discovery %q, expected %s:<target>", spec, kind)
+		}
+	default:
+		return nil, fmt.Errorf("unknown discovery %q, expected dns:, srv: or file:", spec)
+	}
+	return d, nil
+}
+
+// lookup finds the backends at the discovery source, sorted by host.
+func (d *discovery) lookup(ctx context.Context) ([]backend, error) {
+	var found []backend
+	switch d.kind {
+	case "dns":
+		addrs, err := dnsResolver.LookupHost(ctx, d.name)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			found = append(found, backend{Host: net.JoinHostPort(addr, d.port)})
+		}
+	case "srv":
+		_, records, err := dnsResolver.LookupSRV(ctx, "", "", d.name)
+		if err != nil {
+			return nil, err
+		}
+		// Only the targets of the lowest priority are used, the others are
+		// fallbacks in the SRV sense.
+		for _, srv := range records {
+			if srv.Priority != records[0].Priority {
+				break
+			}
+			host := strings.TrimSuffix(srv.Target, ".")
+			found = append(found, backend{
+				Host:   net.JoinHostPort(host, strconv.Itoa(int(srv.Port))),
+				Weight: int(srv.Weight),
+			})
+		}
+	case "file":
+		data, err := ioutil.ReadFile(d.name)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &found); err != nil {
+			return nil, fmt.Errorf("cannot parse %s: %s", d.name, err)
+		}
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("no backends found")
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].Host < found[j].Host })
+	return found, nil
+}
+
+// refresh looks the backends up again and reports whether they changed. On
+// failure the backends found before are kept.
+func (d *discovery) refresh(ctx context.Context) (bool, error) {
+	found, err := d.lookup(ctx)
+	if err != nil {
+		return false, fmt.Errorf("discovery of %s failed: %s", d.name, err)
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if reflect.DeepEqual(found, d.backends) {
+		return false, nil
+	}
+	d.backends = found
+	return true, nil
+}
+
+// current returns a copy of the backends found by the last successful refresh.
+func (d *discovery) current() []backend {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]backend(nil), d.backends...)
+}
+
+// watch refreshes the backends every interval and calls reload when they change.
+func (d *discovery) watch(interval time.Duration, reload func()) {
+	for range time.Tick(interval) {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		changed, err := d.refresh(ctx)
+		cancel()
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		if changed {
+			log.Printf("Discovered %d backends at %s", len(d.current()), d.name)
+			reload()
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+
+	gocheck "gopkg.in/check.v1"
+)
+
+type MySuiteDiscovery struct{}
+
+var _ = gocheck.Suite(&MySuiteDiscovery{})
+
+// fakeResolver answers lookups from its maps.
+type fakeResolver struct {
+	hosts map[string][]string
+	srv   map[string][]*net.SRV
+}
+
+func (fr *fakeResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	if addrs, ok := fr.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, fmt.Errorf("no such host %s", host)
+}
+
+func (fr *fakeResolver) LookupSRV(_ context.Context, _, _, name string) (string, []*net.SRV, error) {
+	if records, ok := fr.srv[name]; ok {
+		return name, records, nil
+	}
+	return "", nil, fmt.Errorf("no such host %s", name)
+}
+
+func (s *MySuiteDiscovery) SetUpTest(c *gocheck.C) {
+	dnsResolver = &fakeResolver{hosts: map[string][]string{}, srv: map[string][]*net.SRV{}}
+}
+
+func (s *MySuiteDiscovery) TearDownTest(c *gocheck.C) {
+	dnsResolver = net.DefaultResolver
+	discovered = nil
+}
+
+func (s *MySuiteDiscovery) TestSpec(c *gocheck.C) {
+	d, err := newDiscovery("dns:server:8080")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(d.name, gocheck.Equals, "server")
+	c.Assert(d.port, gocheck.Equals, "8080")
+
+	for _, spec := range []string{"dns:server", "dns:server:http", "srv:", "file:", "consul:server", "server"} {
+		_, err := newDiscovery(spec)
+		c.Assert(err, gocheck.NotNil, gocheck.Commentf(spec))
+	}
+}
+
+func (s *MySuiteDiscovery) TestDNS(c *gocheck.C) {
+	fake := dnsResolver.(*fakeResolver)
+	fake.hosts["server"] = []string{"10.0.0.2", "10.0.0.1"}
+	d, _ := newDiscovery("dns:server:8080")
+
+	changed, err := d.refresh(context.Background())
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(changed, gocheck.Equals, true)
+	c.Assert(d.current(), gocheck.DeepEquals, []backend{{Host: "10.0.0.1:8080"}, {Host: "10.0.0.2:8080"}})
+
+	// The order of the records does not matter.
+	fake.hosts["server"] = []string{"10.0.0.1", "10.0.0.2"}
+	changed, err = d.refresh(context.Background())
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(changed, gocheck.Equals, false)
+
+	// Failed or empty lookups keep the backends found before.
+	delete(fake.hosts, "server")
+	_, err = d.refresh(context.Background())
+	c.Assert(err, gocheck.NotNil)
+	fake.hosts["server"] = nil
+	_, err = d.refresh(context.Background())
+	c.Assert(err, gocheck.ErrorMatches, ".*no backends found")
+	c.Assert(d.current(), gocheck.HasLen, 2)
+}
+
+func (s *MySuiteDiscovery) TestSRV(c *gocheck.C) {
+	dnsResolver.(*fakeResolver).srv["_http._tcp.server"] = []*net.SRV{
+		{Target: "server2.local.", Port: 8080, Priority: 1, Weight: 2},
+		{Target: "server1.local.", Port: 8081, Priority: 1},
+		{Target: "backup.local.", Port: 8080, Priority: 2},
+	}
+	d, _ := newDiscovery("srv:_http._tcp.server")
+
+	_, err := d.refresh(context.Background())
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(d.current(), gocheck.DeepEquals, []backend{
+		{Host: "server1.local:8081"},
+		{Host: "server2.local:8080", Weight: 2},
+	})
+}
+
+func (s *MySuiteDiscovery) TestRegistryFile(c *gocheck.C) {
+	path := filepath.Join(c.MkDir(), "registry.json")
+	c.Assert(ioutil.WriteFile(path, []byte(`["b:8080", {"host": "a:8080", "weight": 3}]`), 0o600), gocheck.IsNil)
+	discovered, _ = newDiscovery("file:" + path)
+
+	_, err := discovered.refresh(context.Background())
+	c.Assert(err, gocheck.IsNil)
+	cfg, err := loadConfig()
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(cfg.Backends, gocheck.HasLen, 2)
+	c.Assert(cfg.Backends[0].Host, gocheck.Equals, "a:8080")
+	c.Assert(cfg.Backends[0].Weight, gocheck.Equals, 3)
+
+	c.Assert(ioutil.WriteFile(path, []byte(`{"backends": []}`), 0o600), gocheck.IsNil)
+	_, err = discovered.refresh(context.Background())
+	c.Assert(err, gocheck.ErrorMatches, ".*cannot parse.*")
+}
+
+func (s *MySuiteDiscovery) TestPoolFollowsDiscovery(c *gocheck.C) {
+	fake := dnsResolver.(*fakeResolver)
+	fake.hosts["server"] = []string{"10.0.0.1", "10.0.0.2"}
+	d, _ := newDiscovery("dns:server:8080")
+	_, _ = d.refresh(context.Background())
+	pool, _ := Initialize(d.current(), &leastConnections{})
+	first, restore, _ := pool.acquire(httptest.NewRequest("GET", "/", nil))
+
+	// Scaling up adds a server, the busy one keeps its requests in flight.
+	fake.hosts["server"] = []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+	changed, _ := d.refresh(context.Background())
+	c.Assert(changed, gocheck.Equals, true)
+	added, removed := pool.update(d.current())
+	c.Assert(added, gocheck.HasLen, 1)
+	c.Assert(added[0].host, gocheck.Equals, "10.0.0.3:8080")
+	c.Assert(removed, gocheck.HasLen, 0)
+	c.Assert(first.counter, gocheck.Equals, 1)
+
+	// Scaling down drains the server that disappeared.
+	fake.hosts["server"] = []string{"10.0.0.2", "10.0.0.3"}
+	_, _ = d.refresh(context.Background())
+	_, removed = pool.update(d.current())
+	c.Assert(removed, gocheck.DeepEquals, []*server{first})
+	c.Assert(first.draining, gocheck.Equals, true)
+	restore()
+	c.Assert(first.counter, gocheck.Equals, 0)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"time"
+)
+
+var drainTimeout = flag.Duration("drain-timeout", 30*time.Second,
+	"how long a backend being removed may finish its in-flight requests")
+
+// drainPoll is how often a draining server is checked for in-flight requests.
+const drainPoll = 100 * time.Millisecond
+
+// drain stops sending new requests to server and removes it from the pool
+// once its in-flight requests finish or timeout passes, then calls done.
+// Draining is cancelled if the server is enabled again meanwhile.
+func (sp *serverPool) drain(server *server, timeout time.Duration, done func(s *server)) {
+	sp.mutex.Lock()
+	running := !server.drainDeadline.IsZero()
+	server.draining = true
+	server.drainDeadline = time.Now().Add(timeout)
+	inFlight := server.counter
+	sp.mutex.Unlock()
+
+	log.Printf("Draining %s with %d requests in flight for up to %s", server.host, inFlight, timeout)
+	if !running {
+		go sp.waitDrained(server, done)
+	}
+}
+
+func (sp *serverPool) waitDrained(server *server, done func(s *server)) {
+	ticker := time.NewTicker(drainPoll)
+	defer ticker.Stop()
+
+	lastLog := time.Now()
+	for now := range ticker.C {
+		sp.mutex.Lock()
+		if !server.draining {
+			server.drainDeadline = time.Time{}
+			sp.mutex.Unlock()
+			log.Printf("Draining of %s cancelled", server.host)
+			return
+		}
+		inFlight := server.counter
+		expired := now.After(server.drainDeadline)
+		if inFlight == 0 || expired {
+			sp.removeLocked(server)
+			sp.mutex.Unlock()
+			if inFlight > 0 {
+				log.Printf("Drain deadline of %s passed, removed with %d requests in flight", server.host, inFlight)
+			} else {
+				log.Printf("Backend %s drained and removed", server.host)
+			}
+			done(server)
+			return
+		}
+		sp.mutex.Unlock()
+
+		if now.Sub(lastLog) >= time.Second {
+			log.Printf("Draining %s: %d requests in flight", server.host, inFlight)
+			lastLog = now
+		}
+	}
+}
+
+func (sp *serverPool) removeLocked(server *server) {
+	for i, s := range sp.servers {
+		if s == server {
+			sp.servers = append(sp.servers[:i:i], sp.servers[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"math"
+	"net/http"
+	"time"
+)
+
+var ewmaDecay = flag.Duration("ewma-decay", 10*time.Second, "time constant of the latency average peak-ewma balances on")
+
+// ewma is a peak-sensitive exponentially weighted moving average of the
+// response latency: it jumps to a spike at once and decays towards lower
+// observations with the time constant, so a backend turning slow is
+// avoided right away while recovery is trusted gradually.
+type ewma struct {
+	value   float64
+	updated time.Time
+}
+
+func (e *ewma) observe(latency time.Duration, now time.Time, decay time.Duration) {
+	sample := float64(latency)
+	if e.updated.IsZero() || sample > e.value {
+		e.value, e.updated = sample, now
+		return
+	}
+	w := math.Exp(-float64(now.Sub(e.updated)) / float64(decay))
+	e.value = e.value*w + sample*(1-w)
+	e.updated = now
+}
+
+func (e *ewma) duration() time.Duration {
+	return time.Duration(e.value)
+}
+
+// peakEWMA picks the server with the lowest latency average multiplied by
+// the requests in flight plus one, the expected wait of a new request.
+// Servers without observations are scored with the lowest known average and
+// win ties, so that a new backend gets its first requests.
+type peakEWMA struct{}
+
+func (pe *peakEWMA) Pick(servers []*server, _ *http.Request) *server {
+	servers = rampUp(servers, time.Now(), *slowStart)
+	baseline := 0.0
+	for _, server := range servers {
+		if v := server.ewma.value; v > 0 && (baseline == 0 || v < baseline) {
+			baseline = v
+		}
+	}
+	if baseline == 0 {
+		return leastLoaded(servers)
+	}
+
+	var (
+		chosen *server
+		best   float64
+	)
+	for _, server := range servers {
+		latency := server.ewma.value
+		if latency == 0 {
+			latency = baseline
+		}
+		score := latency * float64(server.counter+1)
+		if chosen == nil || score < best || (score == best && server.ewma.value == 0 && chosen.ewma.value > 0) {
+			chosen, best = server, score
+		}
+	}
+	return chosen
+}
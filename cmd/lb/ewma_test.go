@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	gocheck "gopkg.in/check.v1"
+)
+
+type MySuiteEWMA struct {
+	backends []*httptest.Server
+}
+
+var _ = gocheck.Suite(&MySuiteEWMA{})
+
+func (s *MySuiteEWMA) TearDownTest(c *gocheck.C) {
+	for _, backend := range s.backends {
+		backend.Close()
+	}
+	s.backends = nil
+}
+
+func (s *MySuiteEWMA) TestObserve(c *gocheck.C) {
+	var e ewma
+	now := time.Now()
+	e.observe(10*time.Millisecond, now, time.Second)
+	c.Assert(e.duration(), gocheck.Equals, 10*time.Millisecond)
+
+	// Spikes are taken at once.
+	e.observe(100*time.Millisecond, now, time.Second)
+	c.Assert(e.duration(), gocheck.Equals, 100*time.Millisecond)
+
+	// Lower values pull the average down with the time constant.
+	e.observe(10*time.Millisecond, now.Add(time.Second), time.Second)
+	c.Assert(e.duration() > 40*time.Millisecond && e.duration() < 50*time.Millisecond, gocheck.Equals, true,
+		gocheck.Commentf("average %s", e.duration()))
+	e.observe(10*time.Millisecond, now.Add(time.Minute), time.Second)
+	c.Assert(e.duration().Round(time.Millisecond), gocheck.Equals, 10*time.Millisecond)
+}
+
+// delayed starts a backend answering after the delay in milliseconds held by delay.
+func (s *MySuiteEWMA) delayed(delay *int64) *server {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Duration(atomic.LoadInt64(delay)) * time.Millisecond)
+	}))
+	s.backends = append(s.backends, ts)
+	return hostOf(ts)
+}
+
+func (s *MySuiteEWMA) TestTrafficShift(c *gocheck.C) {
+	defer func(old time.Duration) { *ewmaDecay = old }(*ewmaDecay)
+	*ewmaDecay = 100 * time.Millisecond
+
+	delayA, delayB := int64(40), int64(0)
+	a, b := s.delayed(&delayA), s.delayed(&delayB)
+	f := testFrontend(a, b)
+	f.pool.balancer = &peakEWMA{}
+
+	served := func(n int) map[*server]int {
+		picks := make(map[*server]int)
+		for i := 0; i < n; i++ {
+			f.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		}
+		f.pool.mutex.Lock()
+		defer f.pool.mutex.Unlock()
+		picks[a], picks[b] = int(a.stats.requests), int(b.stats.requests)
+		a.stats.requests, b.stats.requests = 0, 0
+		return picks
+	}
+
+	picks := served(30)
+	c.Assert(picks[a] <= 2, gocheck.Equals, true, gocheck.Commentf("slow backend got %d of 30", picks[a]))
+
+	// Once the fast backend slows down more than the other one, traffic moves away from it.
+	atomic.StoreInt64(&delayA, 0)
+	atomic.StoreInt64(&delayB, 80)
+	picks = served(30)
+	c.Assert(picks[b] <= 2, gocheck.Equals, true, gocheck.Commentf("slow backend got %d of 30", picks[b]))
+	c.Assert(picks[a] >= 28, gocheck.Equals, true)
+}
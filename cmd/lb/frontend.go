@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ReallyGreatBand/lab2.2/tracing"
+)
+
+// maxRetryBody is the largest request body kept in memory to be replayed on retries.
+const maxRetryBody = 1 << 20
+
+var (
+	retries     = flag.Int("retries", 0, "how many other backends an idempotent request is retried on after a connection error or a per-try timeout, 0 disables retries")
+	retryBudget = flag.Duration("retry-budget", 9*time.Second, "total time a request may spend on all attempts")
+)
+
+// frontend handles client requests by forwarding them to the pool backends.
+type frontend struct {
+	pool     *serverPool
+	sessions *stickySessions
+	limits   *rateLimits
+	// router sends some requests to other pools than pool, it may be nil.
+	router *router
+	access *accessLog
+	// cache holds responses to GET requests, it may be nil.
+	cache *responseCache
+}
+
+func (f *frontend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	started := time.Now()
+	trace := tracing.FromRequest(r)
+	r = r.WithContext(tracing.NewContext(r.Context(), trace))
+	w.Header().Set(tracing.RequestIDHeader, trace.RequestID)
+	up := upstream{name: defaultPool, pool: f.pool, sessions: f.sessions}
+	if routed, ok := f.router.match(r); ok {
+		up = routed
+	}
+	rw := newResponseRecorder(w)
+	defer func() {
+		f.access.write(r, rw, up.name, started)
+	}()
+
+	if f.limits != nil {
+		if ok, wait := f.limits.allow(r); !ok {
+			rw.Header().Set("Retry-After", retryAfter(wait))
+			rw.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+	}
+	pool, sessions := up.pool, up.sessions
+	if isUpgrade(r) {
+		f.upgrade(rw, r, pool)
+		return
+	}
+
+	// out is where the response goes, through the cache if it is used.
+	var (
+		out http.ResponseWriter = rw
+		cw  *cacheWriter
+	)
+	if f.cache != nil && usesCache(r) {
+		entry := f.cache.lookup(r)
+		if entry != nil && entry.fresh(time.Now()) && !needsRevalidation(r) {
+			f.cache.record("hit")
+			f.cache.serve(rw, r, entry, "hit")
+			return
+		}
+		if entry != nil && !hasValidator(entry) {
+			entry = nil
+		}
+		cw = f.cache.writer(rw, r, entry)
+		out = cw
+		if entry != nil {
+			r = conditional(r, entry)
+		}
+	}
+
+	deadline := time.Now().Add(*retryBudget)
+	attempts := 1
+	if isIdempotent(r.Method) {
+		attempts += *retries
+	}
+	body, replayable, err := bufferBody(r, attempts > 1)
+	if err != nil {
+		log.Printf("Failed to read request body: %s", err)
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !replayable {
+		attempts = 1
+	}
+
+	var tried []*server
+	for {
+		server, restore, err := pool.acquire(r, tried...)
+		if err != nil {
+			log.Println(err)
+			if len(tried) > 0 {
+				f.fail(out, len(tried), http.StatusServiceUnavailable)
+			} else {
+				f.fail(out, len(tried), http.StatusInternalServerError)
+			}
+			return
+		}
+		tried = append(tried, server)
+		rw.backend, rw.attempts = server.host, len(tried)
+
+		started := time.Now()
+		resp, cancelTry, err := f.try(deadline, server, pool.sequence(server), r, body)
+		if err == nil {
+			pool.report(server, resp.StatusCode < http.StatusInternalServerError, time.Since(started))
+		} else if r.Context().Err() == nil {
+			pool.report(server, false, 0)
+		} else {
+			pool.abandon(server)
+		}
+		if err == nil {
+			if *traceEnabled {
+				out.Header().Set("lb-attempts", strconv.Itoa(len(tried)))
+			}
+			if sessions != nil {
+				sessions.pin(out, r, server)
+			}
+			err := writeResponse(server.host, out, resp)
+			if cw != nil {
+				cw.finish(err == nil)
+			}
+			cancelTry()
+			restore()
+			return
+		}
+		cancelTry()
+		restore()
+
+		log.Printf("Failed to get response from %s (attempt %d of %d): %s", server.host, len(tried), attempts, err)
+		if len(tried) >= attempts || !time.Now().Before(deadline) {
+			f.fail(out, len(tried), http.StatusServiceUnavailable)
+			return
+		}
+	}
+}
+
+// try makes a single attempt limited by the per-try timeout and the retry
+// deadline. The limits only apply until the response headers arrive, so that
+// streamed responses are not cut off. The returned cancel function has to be
+// called once the response body is consumed.
+func (f *frontend) try(deadline time.Time, server *server, seq uint64, r *http.Request, body []byte) (*http.Response, func(), error) {
+	limit := timeout()
+	if remaining := time.Until(deadline); remaining < limit {
+		limit = remaining
+	}
+	tryCtx, cancel := context.WithCancel(r.Context())
+	timer := time.AfterFunc(limit, cancel)
+
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	} else if r.Body != nil && r.Body != http.NoBody {
+		reader = r.Body
+	}
+	resp, err := forward(tryCtx, server.host, seq, r, reader)
+	timer.Stop()
+	return resp, cancel, err
+}
+
+func (f *frontend) fail(rw http.ResponseWriter, attempts int, status int) {
+	if *traceEnabled && attempts > 0 {
+		rw.Header().Set("lb-attempts", strconv.Itoa(attempts))
+	}
+	rw.WriteHeader(status)
+}
+
+// isIdempotent reports whether a request with method may be safely sent again.
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// bufferBody reads the request body into memory when it has to be replayed.
+// Bodies over maxRetryBody are left streaming and reported as not replayable.
+func bufferBody(r *http.Request, replay bool) ([]byte, bool, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true, nil
+	}
+	if !replay {
+		return nil, false, nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRetryBody+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if len(body) > maxRetryBody {
+		r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+		return nil, false, nil
+	}
+	return body, true, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	gocheck "gopkg.in/check.v1"
+)
+
+type MySuiteFrontend struct {
+	backends []*httptest.Server
+}
+
+var _ = gocheck.Suite(&MySuiteFrontend{})
+
+func (s *MySuiteFrontend) SetUpTest(c *gocheck.C) {
+	*traceEnabled = true
+}
+
+func (s *MySuiteFrontend) TearDownTest(c *gocheck.C) {
+	*traceEnabled = false
+	for _, backend := range s.backends {
+		backend.Close()
+	}
+	s.backends = nil
+}
+
+// backend starts an httptest server answering with its name.
+func (s *MySuiteFrontend) backend(name string) *server {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		_, _ = rw.Write([]byte(name + string(body)))
+	}))
+	s.backends = append(s.backends, ts)
+	return hostOf(ts)
+}
+
+// deadBackend returns a server nothing listens on.
+func (s *MySuiteFrontend) deadBackend() *server {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	ts.Close()
+	return hostOf(ts)
+}
+
+func hostOf(ts *httptest.Server) *server {
+	u, _ := url.Parse(ts.URL)
+	return &server{host: u.Host, weight: 1, status: true}
+}
+
+func testFrontend(servers ...*server) *frontend {
+	return &frontend{
+		pool: &serverPool{
+			servers:  servers,
+			mutex:    new(sync.Mutex),
+			balancer: &leastConnections{},
+		},
+	}
+}
+
+func (s *MySuiteFrontend) TestRetryOnConnectionError(c *gocheck.C) {
+	defer func(old int) { *retries = old }(*retries)
+	*retries = 2
+	dead, alive := s.deadBackend(), s.backend("alive")
+	f := testFrontend(dead, alive)
+
+	rec := httptest.NewRecorder()
+	f.ServeHTTP(rec, httptest.NewRequest("PUT", "/data", strings.NewReader("-body")))
+
+	c.Assert(rec.Code, gocheck.Equals, http.StatusOK)
+	c.Assert(rec.Body.String(), gocheck.Equals, "alive-body")
+	c.Assert(rec.Header().Get("lb-attempts"), gocheck.Equals, "2")
+	c.Assert(dead.counter, gocheck.Equals, 0)
+	c.Assert(alive.latency > 0, gocheck.Equals, true)
+}
+
+func (s *MySuiteFrontend) TestNoRetryByDefault(c *gocheck.C) {
+	f := testFrontend(s.deadBackend(), s.backend("alive"))
+
+	rec := httptest.NewRecorder()
+	f.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	c.Assert(rec.Code, gocheck.Equals, http.StatusServiceUnavailable)
+	c.Assert(rec.Header().Get("lb-attempts"), gocheck.Equals, "1")
+}
+
+func (s *MySuiteFrontend) TestNoRetryForPost(c *gocheck.C) {
+	defer func(old int) { *retries = old }(*retries)
+	*retries = 2
+	f := testFrontend(s.deadBackend(), s.backend("alive"))
+
+	rec := httptest.NewRecorder()
+	f.ServeHTTP(rec, httptest.NewRequest("POST", "/data", strings.NewReader("body")))
+
+	c.Assert(rec.Code, gocheck.Equals, http.StatusServiceUnavailable)
+	c.Assert(rec.Header().Get("lb-attempts"), gocheck.Equals, "1")
+}
+
+func (s *MySuiteFrontend) TestRetriesExhausted(c *gocheck.C) {
+	defer func(old int) { *retries = old }(*retries)
+	*retries = 1
+	f := testFrontend(s.deadBackend(), s.deadBackend(), s.backend("alive"))
+
+	rec := httptest.NewRecorder()
+	f.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	c.Assert(rec.Code, gocheck.Equals, http.StatusServiceUnavailable)
+	c.Assert(rec.Header().Get("lb-attempts"), gocheck.Equals, "2")
+}
+
+func (s *MySuiteFrontend) TestPerTryTimeout(c *gocheck.C) {
+	defer func(old, oldRetries int) { *timeoutSec, *retries = old, oldRetries }(*timeoutSec, *retries)
+	*timeoutSec, *retries = 1, 2
+	slow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	s.backends = append(s.backends, slow)
+	f := testFrontend(hostOf(slow), s.backend("fast"))
+
+	rec := httptest.NewRecorder()
+	f.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	c.Assert(rec.Code, gocheck.Equals, http.StatusOK)
+	c.Assert(rec.Body.String(), gocheck.Equals, "fast")
+	c.Assert(rec.Header().Get("lb-attempts"), gocheck.Equals, "2")
+}
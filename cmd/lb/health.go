@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	healthPath     = flag.String("health-path", "/health", "path of the backend health endpoint")
+	healthInterval = flag.Duration("health-interval", 10*time.Second, "interval between health checks of a backend")
+	healthTimeout  = flag.Duration("health-timeout", 3*time.Second, "timeout of a single health check")
+	healthStatus   = flag.Int("health-status", http.StatusOK, "status code a healthy backend responds with")
+	healthRise     = flag.Int("health-rise", 2, "consecutive successful checks that bring a backend back")
+	healthFall     = flag.Int("health-fall", 3, "consecutive failed checks that take a backend out")
+)
+
+// healthConfig describes the active health checks of a backend. Zero fields
+// fall back to the config-wide settings and then to the flags.
+type healthConfig struct {
+	Path     string   `json:"path"`
+	Interval duration `json:"interval"`
+	Timeout  duration `json:"timeout"`
+	Status   int      `json:"status"`
+	Rise     int      `json:"rise"`
+	Fall     int      `json:"fall"`
+}
+
+// merge fills the zero fields of hc from defaults.
+func (hc healthConfig) merge(defaults healthConfig) healthConfig {
+	if hc.Path == "" {
+		hc.Path = defaults.Path
+	}
+	if hc.Interval <= 0 {
+		hc.Interval = defaults.Interval
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = defaults.Timeout
+	}
+	if hc.Status == 0 {
+		hc.Status = defaults.Status
+	}
+	if hc.Rise <= 0 {
+		hc.Rise = defaults.Rise
+	}
+	if hc.Fall <= 0 {
+		hc.Fall = defaults.Fall
+	}
+	return hc
+}
+
+func (hc healthConfig) withDefaults() healthConfig {
+	return hc.merge(healthConfig{
+		Path:     *healthPath,
+		Interval: duration(*healthInterval),
+		Timeout:  duration(*healthTimeout),
+		Status:   *healthStatus,
+		Rise:     *healthRise,
+		Fall:     *healthFall,
+	})
+}
+
+// duration is a time.Duration written as a string like "5s" in JSON.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// health makes a single health check of dst.
+func health(dst string, cfg healthConfig) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.Timeout))
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET",
+		fmt.Sprintf("%s://%s%s", scheme(), dst, cfg.Path), nil)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode == cfg.Status
+}
+
+// healthChecks runs a health polling goroutine per server and stops it once
+// the server leaves the pool.
+type healthChecks struct {
+	pool  *serverPool
+	mutex *sync.Mutex
+	stops map[*server]chan struct{}
+}
+
+func newHealthChecks(pool *serverPool) *healthChecks {
+	return &healthChecks{
+		pool:  pool,
+		mutex: new(sync.Mutex),
+		stops: make(map[*server]chan struct{}),
+	}
+}
+
+// start checks the server right away, which decides its initial status, and
+// then keeps checking it. Later the status only flips after Rise successful or
+// Fall failed checks in a row.
+func (hc *healthChecks) start(server *server) {
+	stop := make(chan struct{})
+	hc.mutex.Lock()
+	hc.stops[server] = stop
+	hc.mutex.Unlock()
+
+	go func() {
+		cfg := hc.pool.healthConfig(server)
+		state := healthState{status: health(server.host, cfg)}
+		hc.pool.setStatus(server, state.status)
+		log.Println(server.host, state.status)
+
+		for {
+			timer := time.NewTimer(time.Duration(cfg.Interval))
+			select {
+			case <-stop:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			cfg = hc.pool.healthConfig(server)
+			if state.observe(health(server.host, cfg), cfg) {
+				hc.pool.setStatus(server, state.status)
+				log.Println(server.host, state.status)
+			}
+		}
+	}()
+}
+
+// healthState applies the rise and fall thresholds to consecutive check results.
+type healthState struct {
+	status bool
+	streak int
+}
+
+// observe records a check result and reports whether the status flipped.
+func (hs *healthState) observe(healthy bool, cfg healthConfig) bool {
+	if healthy == hs.status {
+		hs.streak = 0
+		return false
+	}
+	hs.streak++
+	if (hs.status && hs.streak >= cfg.Fall) || (!hs.status && hs.streak >= cfg.Rise) {
+		hs.status = healthy
+		hs.streak = 0
+		return true
+	}
+	return false
+}
+
+func (hc *healthChecks) stop(server *server) {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+	if stop, ok := hc.stops[server]; ok {
+		close(stop)
+		delete(hc.stops, server)
+	}
+}
+
+func (sp *serverPool) healthConfig(server *server) healthConfig {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	return server.health.withDefaults()
+}
+
+func (sp *serverPool) setStatus(server *server, status bool) {
+	sp.mutex.Lock()
+	if status && !server.status {
+		server.recovered = time.Now()
+	}
+	server.status = status
+	sp.mutex.Unlock()
+}
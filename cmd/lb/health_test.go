@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	gocheck "gopkg.in/check.v1"
+)
+
+type MySuiteHealth struct{}
+
+var _ = gocheck.Suite(&MySuiteHealth{})
+
+func (s *MySuiteHealth) TestHealthState(c *gocheck.C) {
+	cfg := healthConfig{Rise: 2, Fall: 3}
+	state := healthState{status: true}
+
+	c.Assert(state.observe(false, cfg), gocheck.Equals, false)
+	c.Assert(state.observe(false, cfg), gocheck.Equals, false)
+	c.Assert(state.observe(true, cfg), gocheck.Equals, false)
+	c.Assert(state.observe(false, cfg), gocheck.Equals, false)
+	c.Assert(state.observe(false, cfg), gocheck.Equals, false)
+	c.Assert(state.observe(false, cfg), gocheck.Equals, true)
+	c.Assert(state.status, gocheck.Equals, false)
+
+	c.Assert(state.observe(true, cfg), gocheck.Equals, false)
+	c.Assert(state.observe(true, cfg), gocheck.Equals, true)
+	c.Assert(state.status, gocheck.Equals, true)
+}
+
+func (s *MySuiteHealth) TestHealthConfig(c *gocheck.C) {
+	var cfg config
+	err := json.Unmarshal([]byte(`{
+		"health": {"path": "/ready", "interval": "2s", "fall": 4},
+		"backends": [{"host": "server1:8080", "health": {"interval": "500ms", "status": 204}}]
+	}`), &cfg)
+	c.Assert(err, gocheck.IsNil)
+
+	merged := cfg.Backends[0].Health.merge(cfg.Health).withDefaults()
+	c.Assert(merged, gocheck.DeepEquals, healthConfig{
+		Path:     "/ready",
+		Interval: duration(500 * time.Millisecond),
+		Timeout:  duration(*healthTimeout),
+		Status:   http.StatusNoContent,
+		Rise:     *healthRise,
+		Fall:     4,
+	})
+}
+
+// waitStatus polls the server status under the pool mutex until it equals expected.
+func waitStatus(c *gocheck.C, pool *serverPool, server *server, expected bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if pool.status()[0].Healthy == expected {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	c.Fatalf("%s did not become healthy=%t", server.host, expected)
+}
+
+func (s *MySuiteHealth) TestActiveChecks(c *gocheck.C) {
+	var (
+		healthy int32 = 0
+		checks  int32
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Path, gocheck.Equals, "/ready")
+		atomic.AddInt32(&checks, 1)
+		if atomic.LoadInt32(&healthy) == 1 {
+			rw.WriteHeader(http.StatusNoContent)
+		} else {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	srv := hostOf(ts)
+	srv.health = healthConfig{
+		Path:     "/ready",
+		Interval: duration(time.Hour),
+		Status:   http.StatusNoContent,
+		Rise:     2,
+		Fall:     2,
+	}
+	pool := &serverPool{servers: []*server{srv}, mutex: new(sync.Mutex), balancer: &leastConnections{}}
+	hc := newHealthChecks(pool)
+
+	// The first check happens right away and decides the initial status.
+	hc.start(srv)
+	waitStatus(c, pool, srv, false)
+	hc.stop(srv)
+	c.Assert(atomic.LoadInt32(&checks), gocheck.Equals, int32(1))
+
+	pool.mutex.Lock()
+	srv.health.Interval = duration(10 * time.Millisecond)
+	pool.mutex.Unlock()
+	atomic.StoreInt32(&healthy, 1)
+	hc.start(srv)
+	waitStatus(c, pool, srv, true)
+
+	atomic.StoreInt32(&healthy, 0)
+	waitStatus(c, pool, srv, false)
+	atomic.StoreInt32(&healthy, 1)
+	waitStatus(c, pool, srv, true)
+	hc.stop(srv)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the latency histogram in seconds.
+var latencyBuckets = [...]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// histogram counts observations per latency bucket, the last count is for
+// the ones above all bounds.
+type histogram struct {
+	counts [len(latencyBuckets) + 1]uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	i := 0
+	for i < len(latencyBuckets) && seconds > latencyBuckets[i] {
+		i++
+	}
+	h.counts[i]++
+	h.sum += seconds
+	h.count++
+}
+
+// backendStats are the request counters of a server, guarded by the pool mutex.
+type backendStats struct {
+	requests uint64
+	// errors are connection failures and 5xx responses.
+	errors  uint64
+	latency histogram
+}
+
+type backendMetrics struct {
+	pool        string
+	host        string
+	healthy     bool
+	connections int
+	ewma        time.Duration
+	stats       backendStats
+}
+
+func (sp *serverPool) metrics(pool string) []backendMetrics {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	metrics := make([]backendMetrics, len(sp.servers))
+	for i, s := range sp.servers {
+		metrics[i] = backendMetrics{
+			pool:        pool,
+			host:        s.host,
+			healthy:     s.status,
+			connections: s.counter,
+			ewma:        s.ewma.duration(),
+			stats:       s.stats,
+		}
+	}
+	return metrics
+}
+
+// metricsHandler serves the metrics of all pools and rate limiters in the
+// Prometheus text format.
+func metricsHandler(pool *serverPool, routes *router, limits *rateLimits, cache *responseCache) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		backends := pool.metrics(defaultPool)
+		for _, up := range routes.upstreams() {
+			backends = append(backends, up.pool.metrics(up.name)...)
+		}
+		rw.Header().Set("content-type", "text/plain; version=0.0.4")
+		writeMetrics(rw, backends, limits.status())
+		if cache != nil {
+			writeCacheMetrics(rw, cache.status())
+		}
+	})
+}
+
+func writeMetrics(w io.Writer, backends []backendMetrics, limiters []limiterStatus) {
+	header := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	labels := func(b backendMetrics) string {
+		return fmt.Sprintf("pool=%q,backend=%q", b.pool, b.host)
+	}
+
+	header("lb_backend_requests_total", "counter", "Requests forwarded to the backend, retries included.")
+	for _, b := range backends {
+		fmt.Fprintf(w, "lb_backend_requests_total{%s} %d\n", labels(b), b.stats.requests)
+	}
+	header("lb_backend_errors_total", "counter", "Connection failures and 5xx responses of the backend.")
+	for _, b := range backends {
+		fmt.Fprintf(w, "lb_backend_errors_total{%s} %d\n", labels(b), b.stats.errors)
+	}
+	header("lb_backend_active_connections", "gauge", "Requests in flight on the backend.")
+	for _, b := range backends {
+		fmt.Fprintf(w, "lb_backend_active_connections{%s} %d\n", labels(b), b.connections)
+	}
+	header("lb_backend_healthy", "gauge", "Whether the backend passes its health checks.")
+	for _, b := range backends {
+		healthy := 0
+		if b.healthy {
+			healthy = 1
+		}
+		fmt.Fprintf(w, "lb_backend_healthy{%s} %d\n", labels(b), healthy)
+	}
+	header("lb_backend_latency_ewma_seconds", "gauge", "Peak-sensitive moving average of the backend latency.")
+	for _, b := range backends {
+		fmt.Fprintf(w, "lb_backend_latency_ewma_seconds{%s} %g\n", labels(b), b.ewma.Seconds())
+	}
+	header("lb_backend_latency_seconds", "histogram", "Time until the response headers of the backend arrived.")
+	for _, b := range backends {
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += b.stats.latency.counts[i]
+			fmt.Fprintf(w, "lb_backend_latency_seconds_bucket{%s,le=%q} %d\n",
+				labels(b), strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "lb_backend_latency_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels(b), b.stats.latency.count)
+		fmt.Fprintf(w, "lb_backend_latency_seconds_sum{%s} %g\n", labels(b), b.stats.latency.sum)
+		fmt.Fprintf(w, "lb_backend_latency_seconds_count{%s} %d\n", labels(b), b.stats.latency.count)
+	}
+
+	header("lb_ratelimit_allowed_total", "counter", "Requests let through by the rate limiter.")
+	for _, l := range limiters {
+		fmt.Fprintf(w, "lb_ratelimit_allowed_total{limiter=%q} %d\n", l.Name, l.Allowed)
+	}
+	header("lb_ratelimit_limited_total", "counter", "Requests rejected by the rate limiter.")
+	for _, l := range limiters {
+		fmt.Fprintf(w, "lb_ratelimit_limited_total{limiter=%q} %d\n", l.Name, l.Limited)
+	}
+	header("lb_ratelimit_clients", "gauge", "Clients the rate limiter keeps a bucket for.")
+	for _, l := range limiters {
+		fmt.Fprintf(w, "lb_ratelimit_clients{limiter=%q} %d\n", l.Name, l.Clients)
+	}
+}
+
+func writeCacheMetrics(w io.Writer, status cacheStatus) {
+	for _, metric := range []struct {
+		name, kind, help string
+		value            interface{}
+	}{
+		{"lb_cache_hits_total", "counter", "Requests answered from the response cache.", status.Hits},
+		{"lb_cache_misses_total", "counter", "Requests the response cache had no usable entry for.", status.Misses},
+		{"lb_cache_revalidations_total", "counter", "Stale cache entries confirmed by a backend.", status.Revalidations},
+		{"lb_cache_entries", "gauge", "Responses in the cache.", status.Entries},
+		{"lb_cache_bytes", "gauge", "Size of the cached responses.", status.Size},
+		{"lb_cache_budget_bytes", "gauge", "Size the response cache is limited to.", status.Budget},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", metric.name, metric.help, metric.name, metric.kind, metric.name, metric.value)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	gocheck "gopkg.in/check.v1"
+)
+
+type MySuiteMetrics struct {
+	backends []*httptest.Server
+}
+
+var _ = gocheck.Suite(&MySuiteMetrics{})
+
+func (s *MySuiteMetrics) TearDownTest(c *gocheck.C) {
+	for _, backend := range s.backends {
+		backend.Close()
+	}
+	s.backends = nil
+}
+
+func (s *MySuiteMetrics) TestHistogram(c *gocheck.C) {
+	var h histogram
+	h.observe(time.Millisecond)
+	h.observe(5 * time.Millisecond)
+	h.observe(300 * time.Millisecond)
+	h.observe(time.Minute)
+
+	c.Assert(h.counts[0], gocheck.Equals, uint64(2))
+	c.Assert(h.counts[6], gocheck.Equals, uint64(1))
+	c.Assert(h.counts[len(latencyBuckets)], gocheck.Equals, uint64(1))
+	c.Assert(h.count, gocheck.Equals, uint64(4))
+}
+
+func (s *MySuiteMetrics) TestAccessLog(c *gocheck.C) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, _ = rw.Write([]byte("hello"))
+	}))
+	s.backends = append(s.backends, backend)
+	var out bytes.Buffer
+	f := testFrontend(hostOf(backend))
+	f.access = newAccessLog(&out)
+
+	r := httptest.NewRequest("GET", "/api/v1/some-data?key=a", nil)
+	r.Header.Set("X-Request-ID", "abc")
+	f.ServeHTTP(httptest.NewRecorder(), r)
+
+	var entry accessEntry
+	c.Assert(json.Unmarshal(out.Bytes(), &entry), gocheck.IsNil)
+	c.Assert(entry.RequestID, gocheck.Equals, "abc")
+	c.Assert(entry.Method, gocheck.Equals, "GET")
+	c.Assert(entry.URI, gocheck.Equals, "/api/v1/some-data?key=a")
+	c.Assert(entry.Pool, gocheck.Equals, defaultPool)
+	c.Assert(entry.Backend, gocheck.Equals, hostOf(backend).host)
+	c.Assert(entry.Attempts, gocheck.Equals, 1)
+	c.Assert(entry.Status, gocheck.Equals, http.StatusOK)
+	c.Assert(entry.Bytes, gocheck.Equals, int64(5))
+	c.Assert(entry.LatencyMs > 0, gocheck.Equals, true)
+}
+
+func (s *MySuiteMetrics) TestMetrics(c *gocheck.C) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			rw.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	s.backends = append(s.backends, backend)
+	live := hostOf(backend)
+	f := testFrontend(live)
+	for _, path := range []string{"/", "/", "/fail"} {
+		f.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	limits, err := newRateLimits("1:1", "", "ip")
+	c.Assert(err, gocheck.IsNil)
+	limits.allow(httptest.NewRequest("GET", "/", nil))
+
+	rec := httptest.NewRecorder()
+	metricsHandler(f.pool, nil, limits, nil).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	c.Assert(rec.Code, gocheck.Equals, http.StatusOK)
+	lines := strings.Split(rec.Body.String(), "\n")
+
+	labels := `{pool="default",backend="` + live.host + `"}`
+	for _, expected := range []string{
+		"lb_backend_requests_total" + labels + " 3",
+		"lb_backend_errors_total" + labels + " 1",
+		"lb_backend_active_connections" + labels + " 0",
+		"lb_backend_healthy" + labels + " 1",
+		"lb_backend_latency_seconds_count" + labels + " 3",
+		`lb_backend_latency_seconds_bucket{pool="default",backend="` + live.host + `",le="+Inf"} 3`,
+		`lb_ratelimit_allowed_total{limiter="global"} 1`,
+		`lb_ratelimit_clients{limiter="global"} 1`,
+	} {
+		c.Check(hasLine(lines, expected), gocheck.Equals, true, gocheck.Commentf("missing %s", expected))
+	}
+}
+
+func hasLine(lines []string, line string) bool {
+	for _, l := range lines {
+		if l == line {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ReallyGreatBand/lab2.2/tracing"
+)
+
+// viaPseudonym identifies the balancer in Via headers.
+const viaPseudonym = "lb"
+
+// instanceName is stamped on forwarded requests as lb-author, so that
+// backends can tell which balancer sent them.
+var instanceName = flag.String("name", "", "identity of this balancer in the lb-author header, the host name by default")
+
+// transport sends requests to backends. Unlike http.DefaultClient it never
+// follows redirects, they are passed on to the client.
+var transport http.RoundTripper = http.DefaultTransport
+
+// hopHeaders are meaningful only for a single connection and must not be
+// passed on by proxies, see RFC 7230 section 6.1.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders deletes the hop-by-hop headers, including the ones listed
+// in the Connection header.
+func removeHopHeaders(h http.Header) {
+	for _, value := range h["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// forward sends r to dst with body as its content, seq is the number of the
+// request among the ones sent to dst. An error means that no response was
+// received and the request may be retried on another backend.
+func forward(ctx context.Context, dst string, seq uint64, r *http.Request, body io.Reader) (*http.Response, error) {
+	fwdRequest := r.Clone(ctx)
+	fwdRequest.RequestURI = ""
+	fwdRequest.URL.Host = dst
+	fwdRequest.URL.Scheme = scheme()
+	fwdRequest.Host = dst
+	fwdRequest.Body = ioutil.NopCloser(body)
+	if body == nil {
+		fwdRequest.Body = nil
+	}
+	fwdRequest.Close = false
+
+	removeHopHeaders(fwdRequest.Header)
+	addForwardingHeaders(fwdRequest.Header, r)
+	tracing.Inject(ctx, fwdRequest.Header)
+	stamp(fwdRequest.Header, seq)
+
+	return transport.RoundTrip(fwdRequest)
+}
+
+// stamp marks a request with the balancer identity and its per-backend
+// counter, replacing the values a client may have sent.
+func stamp(h http.Header, seq uint64) {
+	h.Set("lb-author", *instanceName)
+	h.Set("lb-req-cnt", strconv.FormatUint(seq, 10))
+}
+
+// addForwardingHeaders tells the backend who the client is and how it reached the balancer.
+func addForwardingHeaders(h http.Header, r *http.Request) {
+	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := h.Get("X-Forwarded-For"); prior != "" {
+			clientIP = prior + ", " + clientIP
+		}
+		h.Set("X-Forwarded-For", clientIP)
+	}
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	h.Set("X-Forwarded-Proto", proto)
+	h.Set("X-Forwarded-Host", r.Host)
+	h.Add("Via", via(r.ProtoMajor, r.ProtoMinor))
+}
+
+// via returns the Via header value for a message of the given protocol version.
+func via(major, minor int) string {
+	if major == 1 {
+		return fmt.Sprintf("1.%d %s", minor, viaPseudonym)
+	}
+	return fmt.Sprintf("%d %s", major, viaPseudonym)
+}
+
+// writeResponse copies the backend response to the client. Streamed
+// responses are flushed as they arrive and trailers are passed on. An error
+// means that the client got only a part of the body.
+func writeResponse(dst string, rw http.ResponseWriter, resp *http.Response) error {
+	defer resp.Body.Close()
+	removeHopHeaders(resp.Header)
+	// The frontend sets the request ID of the response itself.
+	resp.Header.Del(tracing.RequestIDHeader)
+	for k, values := range resp.Header {
+		for _, value := range values {
+			rw.Header().Add(k, value)
+		}
+	}
+	rw.Header().Add("Via", via(resp.ProtoMajor, resp.ProtoMinor))
+	if *traceEnabled {
+		rw.Header().Set("lb-from", dst)
+	}
+
+	announced := len(resp.Trailer)
+	for name := range resp.Trailer {
+		rw.Header().Add("Trailer", name)
+	}
+
+	log.Println("fwd", resp.StatusCode, resp.Request.URL)
+	rw.WriteHeader(resp.StatusCode)
+	err := copyBody(rw, resp.Body, isStreamed(resp))
+	if err != nil {
+		log.Printf("Failed to write response: %s", err)
+	}
+
+	// Trailers that were not announced before the body can still be sent
+	// with the TrailerPrefix.
+	for name, values := range resp.Trailer {
+		if len(resp.Trailer) != announced {
+			name = http.TrailerPrefix + name
+		}
+		for _, value := range values {
+			rw.Header().Add(name, value)
+		}
+	}
+	return err
+}
+
+// isStreamed reports whether the response has to reach the client piece by
+// piece rather than when buffers fill up.
+func isStreamed(resp *http.Response) bool {
+	return resp.ContentLength == -1 ||
+		strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream")
+}
+
+func copyBody(rw http.ResponseWriter, body io.Reader, flush bool) error {
+	flusher, ok := rw.(http.Flusher)
+	flush = flush && ok
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, writeErr := rw.Write(buf[:n]); writeErr != nil {
+				return writeErr
+			}
+			if flush {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/ReallyGreatBand/lab2.2/tracing"
+	gocheck "gopkg.in/check.v1"
+)
+
+type MySuiteProxy struct {
+	servers []*httptest.Server
+}
+
+var _ = gocheck.Suite(&MySuiteProxy{})
+
+func (s *MySuiteProxy) TearDownTest(c *gocheck.C) {
+	for _, ts := range s.servers {
+		ts.Close()
+	}
+	s.servers = nil
+}
+
+// start runs the balancer in front of a backend served by handler and returns its URL.
+func (s *MySuiteProxy) start(handler http.HandlerFunc) string {
+	backend := httptest.NewServer(handler)
+	lb := httptest.NewServer(testFrontend(hostOf(backend)))
+	s.servers = append(s.servers, backend, lb)
+	return lb.URL
+}
+
+func (s *MySuiteProxy) TestHopByHopHeaders(c *gocheck.C) {
+	var received http.Header
+	url := s.start(func(rw http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		rw.Header().Set("Connection", "X-Backend-Hop")
+		rw.Header().Set("X-Backend-Hop", "1")
+		rw.Header().Set("Keep-Alive", "timeout=5")
+		rw.Header().Set("X-Backend", "1")
+	})
+
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set("Connection", "X-Client-Hop")
+	req.Header.Set("X-Client-Hop", "1")
+	req.Header.Set("Proxy-Authorization", "Basic Zm9vOmJhcg==")
+	req.Header.Set("X-Client", "1")
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, gocheck.IsNil)
+	resp.Body.Close()
+
+	c.Check(received.Get("X-Client"), gocheck.Equals, "1")
+	c.Check(received.Get("X-Client-Hop"), gocheck.Equals, "")
+	c.Check(received.Get("Proxy-Authorization"), gocheck.Equals, "")
+	c.Check(resp.Header.Get("X-Backend"), gocheck.Equals, "1")
+	c.Check(resp.Header.Get("X-Backend-Hop"), gocheck.Equals, "")
+	c.Check(resp.Header.Get("Keep-Alive"), gocheck.Equals, "")
+}
+
+func (s *MySuiteProxy) TestForwardingHeaders(c *gocheck.C) {
+	var received *http.Request
+	url := s.start(func(rw http.ResponseWriter, r *http.Request) {
+		received = r
+	})
+
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Host = "example.com"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, gocheck.IsNil)
+	resp.Body.Close()
+
+	c.Check(received.Header.Get("X-Forwarded-For"), gocheck.Equals, "203.0.113.7, 127.0.0.1")
+	c.Check(received.Header.Get("X-Forwarded-Proto"), gocheck.Equals, "http")
+	c.Check(received.Header.Get("X-Forwarded-Host"), gocheck.Equals, "example.com")
+	c.Check(received.Header.Get("Via"), gocheck.Equals, "1.1 lb")
+	c.Check(resp.Header.Get("Via"), gocheck.Equals, "1.1 lb")
+}
+
+func (s *MySuiteProxy) TestRedirectsPassedOn(c *gocheck.C) {
+	url := s.start(func(rw http.ResponseWriter, r *http.Request) {
+		http.Redirect(rw, r, "/elsewhere", http.StatusFound)
+	})
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(url)
+	c.Assert(err, gocheck.IsNil)
+	resp.Body.Close()
+	c.Check(resp.StatusCode, gocheck.Equals, http.StatusFound)
+	c.Check(resp.Header.Get("Location"), gocheck.Equals, "/elsewhere")
+}
+
+func (s *MySuiteProxy) TestTrailers(c *gocheck.C) {
+	url := s.start(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Trailer", "X-Checksum")
+		_, _ = rw.Write([]byte("payload"))
+		rw.Header().Set("X-Checksum", "abc")
+		rw.Header().Set(http.TrailerPrefix+"X-Late", "def")
+	})
+
+	resp, err := http.Get(url)
+	c.Assert(err, gocheck.IsNil)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, gocheck.IsNil)
+	c.Check(string(body), gocheck.Equals, "payload")
+	c.Check(resp.Trailer.Get("X-Checksum"), gocheck.Equals, "abc")
+	c.Check(resp.Trailer.Get("X-Late"), gocheck.Equals, "def")
+}
+
+func (s *MySuiteProxy) TestStreaming(c *gocheck.C) {
+	release := make(chan struct{})
+	defer close(release)
+	url := s.start(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/event-stream")
+		_, _ = rw.Write([]byte("data: first\n\n"))
+		rw.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		_, _ = rw.Write([]byte("data: second\n\n"))
+	})
+
+	lines := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			lines <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		line, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		lines <- line
+	}()
+	select {
+	case line := <-lines:
+		c.Check(strings.TrimSpace(line), gocheck.Equals, "data: first")
+	case <-time.After(2 * time.Second):
+		c.Fatal("the first event was not flushed before the stream ended")
+	}
+}
+
+func (s *MySuiteProxy) TestTracing(c *gocheck.C) {
+	var received http.Header
+	url := s.start(func(rw http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		rw.Header().Set(tracing.RequestIDHeader, r.Header.Get(tracing.RequestIDHeader))
+	})
+
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req.Header.Set(tracing.RequestIDHeader, "client-id")
+	req.Header.Set(tracing.TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, gocheck.IsNil)
+	resp.Body.Close()
+
+	c.Check(received.Get(tracing.RequestIDHeader), gocheck.Equals, "client-id")
+	c.Check(received.Get(tracing.TraceparentHeader), gocheck.Matches, "00-4bf92f3577b34da6a3ce929d0e0e4736-[0-9a-f]{16}-01")
+	c.Check(received.Get(tracing.TraceparentHeader), gocheck.Not(gocheck.Equals), req.Header.Get(tracing.TraceparentHeader))
+	c.Check(resp.Header.Values(tracing.RequestIDHeader), gocheck.DeepEquals, []string{"client-id"})
+
+	resp, err = http.Get(url)
+	c.Assert(err, gocheck.IsNil)
+	resp.Body.Close()
+	c.Check(received.Get(tracing.RequestIDHeader), gocheck.Matches, "[0-9a-f]{32}")
+	c.Check(received.Get(tracing.TraceparentHeader), gocheck.Matches, "00-[0-9a-f]{32}-[0-9a-f]{16}-01")
+	c.Check(resp.Header.Get(tracing.RequestIDHeader), gocheck.Equals, received.Get(tracing.RequestIDHeader))
+}
+
+func (s *MySuiteProxy) TestStamp(c *gocheck.C) {
+	defer func(old string) { *instanceName = old }(*instanceName)
+	*instanceName = "lb-1"
+	var authors, counters []string
+	url := s.start(func(rw http.ResponseWriter, r *http.Request) {
+		authors = append(authors, r.Header.Get("lb-author"))
+		counters = append(counters, r.Header.Get("lb-req-cnt"))
+	})
+
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("lb-author", "forged")
+		req.Header.Set("lb-req-cnt", "100")
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, gocheck.IsNil)
+		resp.Body.Close()
+	}
+	c.Check(authors, gocheck.DeepEquals, []string{"lb-1", "lb-1", "lb-1"})
+	c.Check(counters, gocheck.DeepEquals, []string{"1", "2", "3"})
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	rateLimit   = flag.String("rate-limit", "", "requests per second a client may make in total, as <rate>[:<burst>], empty for no limit")
+	routeLimits = flag.String("rate-limit-routes", "",
+		"comma-separated per-client limits of path prefixes as <prefix>=<rate>[:<burst>], the longest matching prefix applies")
+	rateLimitKey = flag.String("rate-limit-key", "ip", "what identifies a client: ip or header:<name>")
+)
+
+// bucketIdle is how long a client bucket is kept after it refilled completely.
+const bucketIdle = time.Minute
+
+// tokenBucket holds tokens that refill at a constant rate up to a burst.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take removes a token if there is one, otherwise it returns how long it
+// takes for the next one to arrive.
+func (b *tokenBucket) take(now time.Time, rate float64, burst int) (bool, time.Duration) {
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// rateLimiter keeps a token bucket per client.
+type rateLimiter struct {
+	name  string
+	rate  float64
+	burst int
+
+	mutex   *sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+	allowed uint64
+	limited uint64
+}
+
+func newRateLimiter(name string, rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		name:    name,
+		rate:    rate,
+		burst:   burst,
+		mutex:   new(sync.Mutex),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+func (rl *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	if now.Sub(rl.swept) > bucketIdle {
+		rl.sweepLocked(now)
+	}
+	bucket, ok := rl.buckets[client]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(rl.burst), last: now}
+		rl.buckets[client] = bucket
+	}
+	ok, wait := bucket.take(now, rl.rate, rl.burst)
+	if ok {
+		rl.allowed++
+	} else {
+		rl.limited++
+	}
+	return ok, wait
+}
+
+// sweepLocked forgets the clients whose buckets have been full for a while,
+// they would start with a full bucket anyway.
+func (rl *rateLimiter) sweepLocked(now time.Time) {
+	full := time.Duration(float64(rl.burst) / rl.rate * float64(time.Second))
+	for client, bucket := range rl.buckets {
+		if now.Sub(bucket.last) > full+bucketIdle {
+			delete(rl.buckets, client)
+		}
+	}
+	rl.swept = now
+}
+
+// limiterStatus describes a rate limiter in the admin API.
+type limiterStatus struct {
+	Name    string  `json:"name"`
+	Rate    float64 `json:"rate"`
+	Burst   int     `json:"burst"`
+	Clients int     `json:"clients"`
+	Allowed uint64  `json:"allowed"`
+	Limited uint64  `json:"limited"`
+}
+
+func (rl *rateLimiter) status() limiterStatus {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	return limiterStatus{
+		Name:    rl.name,
+		Rate:    rl.rate,
+		Burst:   rl.burst,
+		Clients: len(rl.buckets),
+		Allowed: rl.allowed,
+		Limited: rl.limited,
+	}
+}
+
+type routeLimiter struct {
+	prefix  string
+	limiter *rateLimiter
+}
+
+// rateLimits applies the global limit and the limit of the longest matching
+// route to every client.
+type rateLimits struct {
+	client func(r *http.Request) string
+	global *rateLimiter
+	// routes are sorted by descending prefix length.
+	routes []routeLimiter
+}
+
+// newRateLimits parses the rate limiting flags, it returns nil when no limit is set.
+func newRateLimits(global, routes, key string) (*rateLimits, error) {
+	if global == "" && routes == "" {
+		return nil, nil
+	}
+	limits := &rateLimits{client: clientIP}
+	if key != "ip" {
+		client, err := requestKey(key)
+		if err != nil || !strings.HasPrefix(key, "header:") {
+			return nil, fmt.Errorf("bad rate limit key %q, expected ip or header:<name>", key)
+		}
+		// Clients without the header are told apart by their address rather
+		// than sharing a bucket, the prefixes keep both kinds of keys apart.
+		limits.client = func(r *http.Request) string {
+			if value := client(r); value != "" {
+				return "header:" + value
+			}
+			return "ip:" + clientIP(r)
+		}
+	}
+	if global != "" {
+		rate, burst, err := parseRate(global)
+		if err != nil {
+			return nil, err
+		}
+		limits.global = newRateLimiter("global", rate, burst)
+	}
+	for _, item := range splitList(routes) {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") {
+			return nil, fmt.Errorf("bad route limit %q, expected <prefix>=<rate>[:<burst>]", item)
+		}
+		rate, burst, err := parseRate(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		limits.routes = append(limits.routes, routeLimiter{
+			prefix:  parts[0],
+			limiter: newRateLimiter(parts[0], rate, burst),
+		})
+	}
+	sort.SliceStable(limits.routes, func(i, j int) bool {
+		return len(limits.routes[i].prefix) > len(limits.routes[j].prefix)
+	})
+	return limits, nil
+}
+
+// parseRate parses <rate>[:<burst>]. The burst defaults to one second worth of requests.
+func parseRate(spec string) (float64, int, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	rate, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || rate <= 0 {
+		return 0, 0, fmt.Errorf("bad rate %q, expected a positive number", parts[0])
+	}
+	burst := int(math.Max(1, math.Ceil(rate)))
+	if len(parts) == 2 {
+		burst, err = strconv.Atoi(parts[1])
+		if err != nil || burst < 1 {
+			return 0, 0, fmt.Errorf("bad burst %q, expected a positive integer", parts[1])
+		}
+	}
+	return rate, burst, nil
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// allow reports whether the client of r is within its limits, otherwise it
+// also returns when the client may retry.
+func (rls *rateLimits) allow(r *http.Request) (bool, time.Duration) {
+	now := time.Now()
+	client := rls.client(r)
+	if rls.global != nil {
+		if ok, wait := rls.global.allow(client, now); !ok {
+			return false, wait
+		}
+	}
+	for _, route := range rls.routes {
+		if strings.HasPrefix(r.URL.Path, route.prefix) {
+			return route.limiter.allow(client, now)
+		}
+	}
+	return true, 0
+}
+
+func (rls *rateLimits) status() []limiterStatus {
+	statuses := []limiterStatus{}
+	if rls == nil {
+		return statuses
+	}
+	if rls.global != nil {
+		statuses = append(statuses, rls.global.status())
+	}
+	for _, route := range rls.routes {
+		statuses = append(statuses, route.limiter.status())
+	}
+	return statuses
+}
+
+// retryAfter formats wait as the whole seconds of a Retry-After header.
+func retryAfter(wait time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(wait.Seconds())))
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	gocheck "gopkg.in/check.v1"
+)
+
+type MySuiteRateLimit struct{}
+
+var _ = gocheck.Suite(&MySuiteRateLimit{})
+
+func (s *MySuiteRateLimit) TestTokenBucket(c *gocheck.C) {
+	rl := newRateLimiter("test", 2, 3)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		ok, _ := rl.allow("client", now)
+		c.Assert(ok, gocheck.Equals, true)
+	}
+	ok, wait := rl.allow("client", now)
+	c.Assert(ok, gocheck.Equals, false)
+	c.Assert(wait, gocheck.Equals, 500*time.Millisecond)
+
+	ok, _ = rl.allow("other", now)
+	c.Assert(ok, gocheck.Equals, true)
+	ok, _ = rl.allow("client", now.Add(500*time.Millisecond))
+	c.Assert(ok, gocheck.Equals, true)
+
+	status := rl.status()
+	c.Assert(status.Clients, gocheck.Equals, 2)
+	c.Assert(status.Allowed, gocheck.Equals, uint64(5))
+	c.Assert(status.Limited, gocheck.Equals, uint64(1))
+
+	rl.allow("other", now.Add(10*time.Minute))
+	c.Assert(rl.status().Clients, gocheck.Equals, 1)
+}
+
+func (s *MySuiteRateLimit) TestParse(c *gocheck.C) {
+	limits, err := newRateLimits("", "", "ip")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(limits, gocheck.IsNil)
+
+	limits, err = newRateLimits("10", "/api=1:2,/api/upload=0.5", "header:X-API-Key")
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(limits.global.burst, gocheck.Equals, 10)
+	c.Assert(limits.routes[0].prefix, gocheck.Equals, "/api/upload")
+	c.Assert(limits.routes[0].limiter.burst, gocheck.Equals, 1)
+	c.Assert(limits.routes[1].limiter.burst, gocheck.Equals, 2)
+
+	for _, bad := range [][3]string{
+		{"0", "", "ip"},
+		{"1:x", "", "ip"},
+		{"", "api=1", "ip"},
+		{"1", "", "query:key"},
+	} {
+		_, err := newRateLimits(bad[0], bad[1], bad[2])
+		c.Assert(err, gocheck.NotNil, gocheck.Commentf("%v", bad))
+	}
+}
+
+func (s *MySuiteRateLimit) TestHeaderKeyFallback(c *gocheck.C) {
+	limits, err := newRateLimits("1:1", "", "header:X-API-Key")
+	c.Assert(err, gocheck.IsNil)
+	request := func(key, remote string) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remote
+		if key != "" {
+			r.Header.Set("X-API-Key", key)
+		}
+		return r
+	}
+
+	ok, _ := limits.allow(request("", "192.0.2.1:1000"))
+	c.Assert(ok, gocheck.Equals, true)
+	ok, _ = limits.allow(request("", "192.0.2.1:1001"))
+	c.Assert(ok, gocheck.Equals, false)
+
+	// Another client without the header has its own bucket, so do header keys.
+	ok, _ = limits.allow(request("", "192.0.2.2:1000"))
+	c.Assert(ok, gocheck.Equals, true)
+	ok, _ = limits.allow(request("alice", "192.0.2.1:1002"))
+	c.Assert(ok, gocheck.Equals, true)
+	ok, _ = limits.allow(request("alice", "192.0.2.3:1000"))
+	c.Assert(ok, gocheck.Equals, false)
+}
+
+func (s *MySuiteRateLimit) TestFrontend(c *gocheck.C) {
+	// Without backends requests let through fail with another status than 429.
+	f := testFrontend()
+	var err error
+	f.limits, err = newRateLimits("100:100", "/slow=0.5:1", "ip")
+	c.Assert(err, gocheck.IsNil)
+
+	request := func(path, remote string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		r.RemoteAddr = remote
+		f.ServeHTTP(rec, r)
+		return rec
+	}
+
+	c.Assert(request("/slow/1", "192.0.2.1:1000").Code, gocheck.Not(gocheck.Equals), http.StatusTooManyRequests)
+	limited := request("/slow/2", "192.0.2.1:1001")
+	c.Assert(limited.Code, gocheck.Equals, http.StatusTooManyRequests)
+	c.Assert(limited.Header().Get("Retry-After"), gocheck.Equals, "2")
+	c.Assert(request("/fast", "192.0.2.1:1002").Code, gocheck.Not(gocheck.Equals), http.StatusTooManyRequests)
+	c.Assert(request("/slow/1", "192.0.2.2:1000").Code, gocheck.Not(gocheck.Equals), http.StatusTooManyRequests)
+
+	rec := adminRequest(adminHandler(f.pool, newHealthChecks(f.pool), f.limits, "secret", time.Second), "GET", "/ratelimits", "secret", "")
+	var statuses []limiterStatus
+	c.Assert(json.NewDecoder(rec.Body).Decode(&statuses), gocheck.IsNil)
+	c.Assert(statuses, gocheck.HasLen, 2)
+	c.Assert(statuses[0].Name, gocheck.Equals, "global")
+	c.Assert(statuses[0].Allowed, gocheck.Equals, uint64(4))
+	c.Assert(statuses[1].Name, gocheck.Equals, "/slow")
+	c.Assert(statuses[1].Clients, gocheck.Equals, 2)
+	c.Assert(statuses[1].Limited, gocheck.Equals, uint64(1))
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// defaultPool names the pool of the top-level backends in routes.
+const defaultPool = "default"
+
+// route sends the requests matching all of its set conditions to a pool.
+type route struct {
+	// Host is matched against the request host without the port, case-insensitively.
+	Host       string   `json:"host"`
+	PathPrefix string   `json:"pathPrefix"`
+	Methods    []string `json:"methods"`
+	// Headers have to be present with exactly these values.
+	Headers map[string]string `json:"headers"`
+	Pool    string            `json:"pool"`
+}
+
+func (rt *route) matches(r *http.Request) bool {
+	if rt.Host != "" {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if !strings.EqualFold(host, rt.Host) {
+			return false
+		}
+	}
+	if !strings.HasPrefix(r.URL.Path, rt.PathPrefix) {
+		return false
+	}
+	if len(rt.Methods) > 0 {
+		allowed := false
+		for _, method := range rt.Methods {
+			allowed = allowed || strings.EqualFold(method, r.Method)
+		}
+		if !allowed {
+			return false
+		}
+	}
+	for name, value := range rt.Headers {
+		if r.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// namedPool is a pool routes refer to by name, with its own balancer and health checks.
+type namedPool struct {
+	name     string
+	strategy string
+	pool     *serverPool
+	sessions *stickySessions
+	checks   *healthChecks
+}
+
+func newNamedPool(name string, cfg poolConfig) (*namedPool, error) {
+	strategyName := cfg.Strategy
+	if strategyName == "" {
+		strategyName = *strategy
+	}
+	balancer, sessions, err := poolBalancer(strategyName)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := Initialize(cfg.Backends, balancer)
+	if err != nil {
+		return nil, err
+	}
+	np := &namedPool{
+		name:     name,
+		strategy: strategyName,
+		pool:     pool,
+		sessions: sessions,
+		checks:   newHealthChecks(pool),
+	}
+	for _, server := range pool.servers {
+		np.checks.start(server)
+	}
+	return np, nil
+}
+
+// poolBalancer creates the balancer of a pool, wrapped in session affinity
+// when the -sticky flag is set.
+func poolBalancer(name string) (Balancer, *stickySessions, error) {
+	balancer, err := newBalancer(name)
+	if err != nil || *sticky == "" {
+		return balancer, nil, err
+	}
+	sessions, err := newStickySessions(*sticky, *stickyCookie, balancer)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sessions, sessions, nil
+}
+
+// update applies a new config of the pool, draining the servers it dropped.
+func (np *namedPool) update(cfg poolConfig) error {
+	strategyName := cfg.Strategy
+	if strategyName == "" {
+		strategyName = *strategy
+	}
+	if strategyName != np.strategy {
+		balancer, sessions, err := poolBalancer(strategyName)
+		if err != nil {
+			return err
+		}
+		np.pool.mutex.Lock()
+		np.pool.balancer = balancer
+		np.pool.mutex.Unlock()
+		np.strategy, np.sessions = strategyName, sessions
+	}
+
+	added, removed := np.pool.update(cfg.Backends)
+	for _, server := range added {
+		np.checks.start(server)
+	}
+	for _, server := range removed {
+		np.pool.drain(server, *drainTimeout, np.checks.stop)
+	}
+	log.Printf("Pool %s reloaded: %d added, %d removed", np.name, len(added), len(removed))
+	return nil
+}
+
+// close drains all servers of a pool that is no longer configured.
+func (np *namedPool) close() {
+	_, removed := np.pool.update(nil)
+	for _, server := range removed {
+		np.pool.drain(server, *drainTimeout, np.checks.stop)
+	}
+	log.Printf("Pool %s removed", np.name)
+}
+
+// router picks the pool of a request by the first matching route.
+type router struct {
+	mutex  *sync.RWMutex
+	routes []route
+	pools  map[string]*namedPool
+}
+
+func newRouter(cfg *config) (*router, error) {
+	rt := &router{
+		mutex: new(sync.RWMutex),
+		pools: make(map[string]*namedPool),
+	}
+	return rt, rt.update(cfg)
+}
+
+// upstream is the pool a request is balanced over.
+type upstream struct {
+	name     string
+	pool     *serverPool
+	sessions *stickySessions
+}
+
+// match returns the named pool r is routed to. It returns false when r goes
+// to the default pool.
+func (rt *router) match(r *http.Request) (upstream, bool) {
+	if rt == nil {
+		return upstream{}, false
+	}
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+	for i := range rt.routes {
+		if !rt.routes[i].matches(r) {
+			continue
+		}
+		if np, ok := rt.pools[rt.routes[i].Pool]; ok {
+			return upstream{name: np.name, pool: np.pool, sessions: np.sessions}, true
+		}
+		return upstream{}, false
+	}
+	return upstream{}, false
+}
+
+// upstreams returns the named pools sorted by name.
+func (rt *router) upstreams() []upstream {
+	if rt == nil {
+		return nil
+	}
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+	ups := make([]upstream, 0, len(rt.pools))
+	for _, np := range rt.pools {
+		ups = append(ups, upstream{name: np.name, pool: np.pool, sessions: np.sessions})
+	}
+	sort.Slice(ups, func(i, j int) bool {
+		return ups[i].name < ups[j].name
+	})
+	return ups
+}
+
+// update replaces the routes and the named pools. Pools that stay keep their
+// servers, pools missing from cfg are drained.
+func (rt *router) update(cfg *config) error {
+	for name, poolCfg := range cfg.Pools {
+		if poolCfg.Strategy == "" {
+			continue
+		}
+		if _, err := newBalancer(poolCfg.Strategy); err != nil {
+			return fmt.Errorf("pool %s: %s", name, err)
+		}
+	}
+
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+
+	pools := make(map[string]*namedPool, len(cfg.Pools))
+	for name, poolCfg := range cfg.Pools {
+		var err error
+		if np, ok := rt.pools[name]; ok {
+			err = np.update(poolCfg)
+			pools[name] = np
+		} else {
+			pools[name], err = newNamedPool(name, poolCfg)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for name, np := range rt.pools {
+		if _, ok := pools[name]; !ok {
+			np.close()
+		}
+	}
+	rt.pools = pools
+	rt.routes = cfg.Routes
+	return nil
+}
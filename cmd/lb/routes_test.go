@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+
+	gocheck "gopkg.in/check.v1"
+)
+
+type MySuiteRoutes struct {
+	backends []*httptest.Server
+}
+
+var _ = gocheck.Suite(&MySuiteRoutes{})
+
+func (s *MySuiteRoutes) TearDownTest(c *gocheck.C) {
+	*configPath = ""
+	for _, backend := range s.backends {
+		backend.Close()
+	}
+	s.backends = nil
+}
+
+func (s *MySuiteRoutes) backend(name string) backend {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, _ = rw.Write([]byte(name))
+	}))
+	s.backends = append(s.backends, ts)
+	return backend{Host: hostOf(ts).host, Health: healthConfig{Path: "/"}.withDefaults()}
+}
+
+func (s *MySuiteRoutes) TestMatch(c *gocheck.C) {
+	rt := route{
+		Host:       "API.example.com",
+		PathPrefix: "/api/v1/",
+		Methods:    []string{"get", "POST"},
+		Headers:    map[string]string{"X-Tenant": "a"},
+	}
+	request := func(method, url string, tenant string) *http.Request {
+		r := httptest.NewRequest(method, url, nil)
+		if tenant != "" {
+			r.Header.Set("X-Tenant", tenant)
+		}
+		return r
+	}
+
+	c.Assert(rt.matches(request("GET", "http://api.example.com:8090/api/v1/users", "a")), gocheck.Equals, true)
+	c.Assert(rt.matches(request("POST", "http://api.example.com/api/v1/", "a")), gocheck.Equals, true)
+	c.Assert(rt.matches(request("GET", "http://www.example.com/api/v1/users", "a")), gocheck.Equals, false)
+	c.Assert(rt.matches(request("GET", "http://api.example.com/api/v2/users", "a")), gocheck.Equals, false)
+	c.Assert(rt.matches(request("DELETE", "http://api.example.com/api/v1/users", "a")), gocheck.Equals, false)
+	c.Assert(rt.matches(request("GET", "http://api.example.com/api/v1/users", "b")), gocheck.Equals, false)
+	c.Assert(rt.matches(request("GET", "http://api.example.com/api/v1/users", "")), gocheck.Equals, false)
+
+	c.Assert((&route{}).matches(request("GET", "/anything", "")), gocheck.Equals, true)
+}
+
+func (s *MySuiteRoutes) TestConfig(c *gocheck.C) {
+	*configPath = filepath.Join(c.MkDir(), "lb.json")
+	write := func(data string) {
+		c.Assert(ioutil.WriteFile(*configPath, []byte(data), 0o600), gocheck.IsNil)
+	}
+
+	write(`{
+		"backends": ["default1:8080"],
+		"health": {"path": "/health"},
+		"pools": {"db": {"backends": ["db1:8080"], "strategy": "round-robin", "health": {"path": "/db/_stats"}}},
+		"routes": [{"pathPrefix": "/db/", "pool": "db"}, {"pathPrefix": "/", "pool": "default"}]
+	}`)
+	cfg, err := loadConfig()
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(cfg.Pools["db"].Backends[0].Health.Path, gocheck.Equals, "/db/_stats")
+	c.Assert(cfg.Backends[0].Health.Path, gocheck.Equals, "/health")
+	c.Assert(cfg.Routes, gocheck.HasLen, 2)
+
+	write(`{"backends": ["default1:8080"], "routes": [{"pathPrefix": "/db/", "pool": "db"}]}`)
+	_, err = loadConfig()
+	c.Assert(err, gocheck.ErrorMatches, `route to unknown pool "db"`)
+
+	write(`{"backends": ["default1:8080"], "pools": {"db": {"backends": []}}}`)
+	_, err = loadConfig()
+	c.Assert(err, gocheck.ErrorMatches, "pool db has no servers")
+
+	write(`{"backends": ["default1:8080"], "pools": {"default": {"backends": ["db1:8080"]}}}`)
+	_, err = loadConfig()
+	c.Assert(err, gocheck.NotNil)
+
+	_, err = newRouter(&config{Pools: map[string]poolConfig{"db": {Backends: []backend{{Host: "db1:8080"}}, Strategy: "random"}}})
+	c.Assert(err, gocheck.ErrorMatches, "pool db: unknown balancing strategy .*")
+}
+
+func (s *MySuiteRoutes) TestRouting(c *gocheck.C) {
+	cfg := &config{
+		Pools: map[string]poolConfig{
+			"api": {Backends: []backend{s.backend("api1"), s.backend("api2")}, Strategy: "round-robin"},
+			"db":  {Backends: []backend{s.backend("db")}},
+		},
+		Routes: []route{
+			{PathPrefix: "/api/", Pool: "api"},
+			{PathPrefix: "/db/", Methods: []string{"GET"}, Pool: "db"},
+		},
+	}
+	routes, err := newRouter(cfg)
+	c.Assert(err, gocheck.IsNil)
+	f := testFrontend(&server{host: s.backend("default").Host, weight: 1, status: true})
+	f.router = routes
+
+	get := func(method, path string) string {
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec.Body.String()
+	}
+	c.Assert(get("GET", "/api/users"), gocheck.Equals, "api1")
+	c.Assert(get("GET", "/api/users"), gocheck.Equals, "api2")
+	c.Assert(get("GET", "/db/key"), gocheck.Equals, "db")
+	c.Assert(get("POST", "/db/key"), gocheck.Equals, "default")
+	c.Assert(get("GET", "/other"), gocheck.Equals, "default")
+
+	// Dropping a pool drains its servers and its routes go to the default pool.
+	api, _ := routes.match(httptest.NewRequest("GET", "/api/", nil))
+	cfg.Pools = map[string]poolConfig{"db": cfg.Pools["db"]}
+	cfg.Routes = cfg.Routes[1:]
+	c.Assert(routes.update(cfg), gocheck.IsNil)
+	c.Assert(get("GET", "/api/users"), gocheck.Equals, "default")
+	c.Assert(get("GET", "/db/key"), gocheck.Equals, "db")
+	waitRemoved(c, api.pool, 0)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"math/rand"
+	"time"
+)
+
+var slowStart = flag.Duration("slow-start", 0,
+	"how long the share of requests of a recovered or newly added backend ramps up, 0 disables slow start")
+
+// slowStartMinShare is the share of requests a backend gets right after it
+// comes back, so that it is not left idle at the start of the window.
+const slowStartMinShare = 0.1
+
+// shareLocked is the part of its usual requests the server takes at now:
+// it grows linearly from slowStartMinShare to one over the window since the
+// server recovered or was added.
+func (s *server) shareLocked(now time.Time, window time.Duration) float64 {
+	if window <= 0 || s.recovered.IsZero() {
+		return 1
+	}
+	elapsed := now.Sub(s.recovered)
+	if elapsed >= window {
+		return 1
+	}
+	share := float64(elapsed) / float64(window)
+	if share < slowStartMinShare {
+		return slowStartMinShare
+	}
+	return share
+}
+
+// rampUp leaves each server in slow start among the candidates only with the
+// probability of its share. The strategies without weights call it on the
+// servers they pick from, so that even least-connections does not flood a
+// server whose counter is zero, while sessions and hashed keys pinned to a
+// server stay on it. The candidates are kept as they are if no server would
+// be left.
+func rampUp(candidates []*server, now time.Time, window time.Duration) []*server {
+	if window <= 0 {
+		return candidates
+	}
+	kept := make([]*server, 0, len(candidates))
+	for _, server := range candidates {
+		if share := server.shareLocked(now, window); share >= 1 || rand.Float64() < share {
+			kept = append(kept, server)
+		}
+	}
+	if len(kept) == 0 {
+		return candidates
+	}
+	return kept
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+
+	gocheck "gopkg.in/check.v1"
+)
+
+type MySuiteSlowStart struct{}
+
+var _ = gocheck.Suite(&MySuiteSlowStart{})
+
+func (s *MySuiteSlowStart) TearDownTest(c *gocheck.C) {
+	*slowStart = 0
+}
+
+func (s *MySuiteSlowStart) TestShare(c *gocheck.C) {
+	now := time.Now()
+	server := &server{}
+	c.Assert(server.shareLocked(now, time.Minute), gocheck.Equals, 1.0)
+
+	server.recovered = now
+	c.Assert(server.shareLocked(now, time.Minute), gocheck.Equals, slowStartMinShare)
+	c.Assert(server.shareLocked(now.Add(30*time.Second), time.Minute), gocheck.Equals, 0.5)
+	c.Assert(server.shareLocked(now.Add(time.Minute), time.Minute), gocheck.Equals, 1.0)
+	c.Assert(server.shareLocked(now, 0), gocheck.Equals, 1.0)
+}
+
+func (s *MySuiteSlowStart) TestRecovery(c *gocheck.C) {
+	pool, _ := Initialize([]backend{{Host: "server1:8080"}}, &leastConnections{})
+	server := pool.servers[0]
+
+	pool.setStatus(server, true)
+	c.Assert(server.recovered.IsZero(), gocheck.Equals, true)
+	pool.setStatus(server, false)
+	pool.setStatus(server, true)
+	c.Assert(server.recovered.IsZero(), gocheck.Equals, false)
+
+	added, _ := pool.update([]backend{{Host: "server1:8080"}, {Host: "server2:8080"}})
+	c.Assert(added[0].recovered.IsZero(), gocheck.Equals, false)
+}
+
+// picks counts how many of n requests acquired from a pool of servers go to
+// the first one, which recovered a quarter of the slow start window ago.
+func picks(balancer Balancer, n int) int {
+	servers := mockServers(1, 1, 1)
+	servers[0].recovered = time.Now().Add(-*slowStart / 4)
+	servers[1].counter, servers[2].counter = 5, 5
+	pool := &serverPool{servers: servers, mutex: new(sync.Mutex), balancer: balancer}
+
+	count := 0
+	req := httptest.NewRequest("GET", "/", nil)
+	for i := 0; i < n; i++ {
+		server, restore, _ := pool.acquire(req)
+		if server == servers[0] {
+			count++
+		}
+		restore()
+	}
+	return count
+}
+
+func (s *MySuiteSlowStart) TestAllStrategies(c *gocheck.C) {
+	strategies := map[string]func() Balancer{
+		"round-robin":          func() Balancer { return &roundRobin{} },
+		"weighted-round-robin": func() Balancer { return &weightedRoundRobin{} },
+		"least-connections":    func() Balancer { return &leastConnections{} },
+		"power-of-two":         func() Balancer { return &powerOfTwo{rand: rand.New(rand.NewSource(1))} },
+		"peak-ewma":            func() Balancer { return &peakEWMA{} },
+	}
+	for name, strategy := range strategies {
+		*slowStart = 0
+		full := picks(strategy(), 2000)
+		*slowStart = time.Minute
+		ramped := picks(strategy(), 2000)
+
+		c.Assert(ramped > 0 && ramped < full/2, gocheck.Equals, true,
+			gocheck.Commentf("%s: %d requests with slow start, %d without", name, ramped, full))
+	}
+
+	// Least connections sends everything to the idle server without slow start.
+	*slowStart = 0
+	c.Assert(picks(&leastConnections{}, 100), gocheck.Equals, 100)
+	*slowStart = time.Minute
+	share := picks(&leastConnections{}, 2000)
+	c.Assert(share > 300 && share < 700, gocheck.Equals, true, gocheck.Commentf("%d of 2000", share))
+}
+
+func (s *MySuiteSlowStart) TestOnlyServerRamping(c *gocheck.C) {
+	*slowStart = time.Minute
+	servers := mockServers(1)
+	servers[0].recovered = time.Now()
+	pool := &serverPool{servers: servers, mutex: new(sync.Mutex), balancer: &roundRobin{}}
+
+	for i := 0; i < 20; i++ {
+		server, restore, err := pool.acquire(httptest.NewRequest("GET", "/", nil))
+		c.Assert(err, gocheck.IsNil)
+		c.Assert(server, gocheck.Equals, servers[0])
+		restore()
+	}
+}
+
+func (s *MySuiteSlowStart) TestWeightedRoundRobinRamping(c *gocheck.C) {
+	*slowStart = time.Minute
+	servers := mockServers(1, 1, 1, 1)
+	servers[0].recovered = time.Now().Add(-*slowStart / 4)
+	pool := &serverPool{servers: servers, mutex: new(sync.Mutex), balancer: &weightedRoundRobin{}}
+
+	counts := make(map[*server]int)
+	req := httptest.NewRequest("GET", "/", nil)
+	for i := 0; i < 1300; i++ {
+		server, restore, _ := pool.acquire(req)
+		counts[server]++
+		restore()
+	}
+	// The healthy servers keep sharing their requests evenly while the
+	// ramping one takes about a quarter of a full share.
+	for _, server := range servers[1:] {
+		c.Assert(counts[server] >= 390 && counts[server] <= 410, gocheck.Equals, true,
+			gocheck.Commentf("%s: %d of 1300", server.host, counts[server]))
+	}
+	c.Assert(counts[servers[0]] > 50 && counts[servers[0]] < 150, gocheck.Equals, true,
+		gocheck.Commentf("%d of 1300", counts[servers[0]]))
+}
+
+func (s *MySuiteSlowStart) TestStickySessionsRamping(c *gocheck.C) {
+	*slowStart = time.Minute
+	servers := mockServers(1, 1, 1)
+	servers[0].recovered = time.Now()
+
+	for _, spec := range []string{"cookie", "header:X-User"} {
+		sessions, err := newStickySessions(spec, "lb-session", &roundRobin{})
+		c.Assert(err, gocheck.IsNil)
+		pool := &serverPool{servers: servers, mutex: new(sync.Mutex), balancer: sessions}
+
+		// A session pinned to the ramping server stays on it.
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: "lb-session", Value: serverID(servers[0])})
+		user := 0
+		for rendezvous(servers, strconv.Itoa(user)) != servers[0] {
+			user++
+		}
+		req.Header.Set("X-User", strconv.Itoa(user))
+		for i := 0; i < 50; i++ {
+			server, restore, _ := pool.acquire(req)
+			restore()
+			c.Assert(server, gocheck.Equals, servers[0], gocheck.Commentf(spec))
+		}
+
+		// Requests without a session ramp the server up as usual.
+		count := 0
+		for i := 0; i < 600; i++ {
+			server, restore, _ := pool.acquire(httptest.NewRequest("GET", "/", nil))
+			if server == servers[0] {
+				count++
+			}
+			restore()
+		}
+		c.Assert(count < 100, gocheck.Equals, true, gocheck.Commentf("%s: %d of 600", spec, count))
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var (
+	sticky = flag.String("sticky", "",
+		"session affinity: cookie to pin clients with an lb-issued cookie or header:<name> to hash on a header, empty disables it")
+	stickyCookie = flag.String("sticky-cookie", "lb-session", "name of the session affinity cookie")
+)
+
+// stickySessions sends requests of the same client to the same server while
+// it stays healthy. Clients are recognized by a cookie issued by the balancer
+// or by the value of a header. Requests without a session, or whose server is
+// not among the healthy ones anymore, are balanced as usual.
+type stickySessions struct {
+	balancer Balancer
+	cookie   string
+	header   string
+}
+
+func newStickySessions(spec, cookie string, balancer Balancer) (*stickySessions, error) {
+	switch {
+	case spec == "cookie":
+		return &stickySessions{balancer: balancer, cookie: cookie}, nil
+	case strings.HasPrefix(spec, "header:") && len(spec) > len("header:"):
+		return &stickySessions{balancer: balancer, header: strings.TrimPrefix(spec, "header:")}, nil
+	}
+	return nil, fmt.Errorf("bad session affinity %q, expected cookie or header:<name>", spec)
+}
+
+func (ss *stickySessions) Pick(servers []*server, r *http.Request) *server {
+	if ss.cookie != "" {
+		if cookie, err := r.Cookie(ss.cookie); err == nil {
+			for _, server := range servers {
+				if serverID(server) == cookie.Value {
+					return server
+				}
+			}
+		}
+	} else if value := r.Header.Get(ss.header); value != "" {
+		return rendezvous(servers, value)
+	}
+	return ss.balancer.Pick(servers, r)
+}
+
+// pin issues the session cookie for server unless r already carries it.
+func (ss *stickySessions) pin(rw http.ResponseWriter, r *http.Request, server *server) {
+	if ss.cookie == "" {
+		return
+	}
+	id := serverID(server)
+	if cookie, err := r.Cookie(ss.cookie); err == nil && cookie.Value == id {
+		return
+	}
+	http.SetCookie(rw, &http.Cookie{
+		Name:     ss.cookie,
+		Value:    id,
+		Path:     "/",
+		HttpOnly: true,
+	})
+}
+
+// serverID identifies a server in cookies without exposing its address.
+func serverID(server *server) string {
+	return strconv.FormatUint(hashString(server.host), 36)
+}
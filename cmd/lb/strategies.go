@@ -0,0 +1,192 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	strategy = flag.String("strategy", "least-connections",
+		"balancing strategy: round-robin, weighted-round-robin, least-connections, power-of-two, consistent-hash or peak-ewma")
+	hashKey = flag.String("hash-key", "query:key",
+		"request attribute consistent-hash balances on, either header:<name> or query:<name>")
+)
+
+// Balancer chooses a backend for a request. Pick receives the non-empty list
+// of servers able to take the request and is called with the pool locked, so
+// implementations may read server counters and keep their own state without
+// extra synchronization.
+type Balancer interface {
+	Pick(servers []*server, r *http.Request) *server
+}
+
+func newBalancer(name string) (Balancer, error) {
+	switch name {
+	case "round-robin":
+		return &roundRobin{}, nil
+	case "weighted-round-robin":
+		return &weightedRoundRobin{}, nil
+	case "least-connections":
+		return &leastConnections{}, nil
+	case "power-of-two":
+		return &powerOfTwo{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}, nil
+	case "peak-ewma":
+		return &peakEWMA{}, nil
+	case "consistent-hash":
+		key, err := requestKey(*hashKey)
+		if err != nil {
+			return nil, err
+		}
+		return &consistentHash{key: key, fallback: &leastConnections{}}, nil
+	}
+	return nil, fmt.Errorf("unknown balancing strategy %q", name)
+}
+
+type roundRobin struct {
+	next int
+}
+
+func (rr *roundRobin) Pick(servers []*server, _ *http.Request) *server {
+	servers = rampUp(servers, time.Now(), *slowStart)
+	chosen := servers[rr.next%len(servers)]
+	rr.next++
+	return chosen
+}
+
+// weightedRoundRobin is the smooth weighted round-robin used by nginx: it
+// spreads the picks of heavier servers evenly instead of sending them in bursts.
+// The weight of a server in slow start is scaled by its share. The running
+// weights are kept on the servers, so that servers left out of a pick, such
+// as the ones already tried, keep their place.
+type weightedRoundRobin struct{}
+
+func (wrr *weightedRoundRobin) Pick(servers []*server, _ *http.Request) *server {
+	now := time.Now()
+	var (
+		chosen *server
+		total  float64
+	)
+	for _, server := range servers {
+		weight := float64(server.weight) * server.shareLocked(now, *slowStart)
+		server.current += weight
+		total += weight
+		if chosen == nil || server.current > chosen.current {
+			chosen = server
+		}
+	}
+	chosen.current -= total
+	return chosen
+}
+
+type leastConnections struct{}
+
+func (lc *leastConnections) Pick(servers []*server, _ *http.Request) *server {
+	return leastLoaded(rampUp(servers, time.Now(), *slowStart))
+}
+
+// leastLoaded returns the server with the fewest requests in flight.
+func leastLoaded(servers []*server) *server {
+	chosen := servers[0]
+	for _, server := range servers[1:] {
+		if server.counter < chosen.counter {
+			chosen = server
+		}
+	}
+	return chosen
+}
+
+// powerOfTwo picks two distinct servers at random and takes the less loaded one.
+type powerOfTwo struct {
+	rand *rand.Rand
+}
+
+func (p2c *powerOfTwo) Pick(servers []*server, _ *http.Request) *server {
+	servers = rampUp(servers, time.Now(), *slowStart)
+	if len(servers) == 1 {
+		return servers[0]
+	}
+	i := p2c.rand.Intn(len(servers))
+	j := p2c.rand.Intn(len(servers) - 1)
+	if j >= i {
+		j++
+	}
+	if servers[j].counter < servers[i].counter {
+		return servers[j]
+	}
+	return servers[i]
+}
+
+// consistentHash uses rendezvous hashing: every server is scored by the hash
+// of the request key and its host, and the highest score wins. Adding or
+// removing a server only moves the keys that scored highest on it. Requests
+// without a key go to the fallback balancer.
+type consistentHash struct {
+	key      func(r *http.Request) string
+	fallback Balancer
+}
+
+func (ch *consistentHash) Pick(servers []*server, r *http.Request) *server {
+	key := ch.key(r)
+	if key == "" {
+		return ch.fallback.Pick(servers, r)
+	}
+
+	return rendezvous(servers, key)
+}
+
+// rendezvous returns the server with the highest score for key.
+func rendezvous(servers []*server, key string) *server {
+	var (
+		chosen  *server
+		best    uint64
+		keyHash = hashString(key)
+	)
+	for _, server := range servers {
+		if score := mix(keyHash ^ hashString(server.host)); chosen == nil || score > best {
+			chosen, best = server, score
+		}
+	}
+	return chosen
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// mix is the splitmix64 finalizer, it spreads close inputs over the whole range.
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// requestKey parses a header:<name> or query:<name> spec into a function
+// extracting that attribute from requests.
+func requestKey(spec string) (func(r *http.Request) string, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("bad request key %q, expected header:<name> or query:<name>", spec)
+	}
+	name := parts[1]
+	switch parts[0] {
+	case "header":
+		return func(r *http.Request) string {
+			return r.Header.Get(name)
+		}, nil
+	case "query":
+		return func(r *http.Request) string {
+			return r.URL.Query().Get(name)
+		}, nil
+	}
+	return nil, fmt.Errorf("bad request key %q, expected header:<name> or query:<name>", spec)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	tlsCert = flag.String("tls-cert", "",
+		"comma-separated certificate files to terminate TLS with, the first one is served to clients without a matching SNI name")
+	tlsKey  = flag.String("tls-key", "", "comma-separated key files of the -tls-cert certificates, in the same order")
+	tlsPoll = flag.Duration("tls-poll", 10*time.Second, "how often certificate files are checked for changes")
+
+	upstreamCA   = flag.String("upstream-ca", "", "PEM bundle of CAs trusted for HTTPs backends instead of the system ones")
+	upstreamCert = flag.String("upstream-cert", "", "client certificate presented to HTTPs backends")
+	upstreamKey  = flag.String("upstream-key", "", "key of the -upstream-cert certificate")
+)
+
+// upstreamTLS is the client configuration for HTTPs backends, nil means the defaults.
+var upstreamTLS *tls.Config
+
+// certStore picks the frontend certificate by the SNI name of the client
+// and reloads the certificates from disk without a restart.
+type certStore struct {
+	certFiles []string
+	keyFiles  []string
+
+	mutex *sync.RWMutex
+	certs []*tls.Certificate
+	names map[string]*tls.Certificate
+}
+
+func newCertStore(certFiles, keyFiles []string) (*certStore, error) {
+	if len(certFiles) == 0 || len(certFiles) != len(keyFiles) {
+		return nil, fmt.Errorf("got %d certificates and %d keys", len(certFiles), len(keyFiles))
+	}
+	cs := &certStore{
+		certFiles: certFiles,
+		keyFiles:  keyFiles,
+		mutex:     new(sync.RWMutex),
+	}
+	return cs, cs.reload()
+}
+
+// reload reads all certificates again. The old ones are kept if any fails to load.
+func (cs *certStore) reload() error {
+	certs := make([]*tls.Certificate, len(cs.certFiles))
+	names := make(map[string]*tls.Certificate)
+	for i := range cs.certFiles {
+		cert, err := tls.LoadX509KeyPair(cs.certFiles[i], cs.keyFiles[i])
+		if err != nil {
+			return fmt.Errorf("loading %s: %s", cs.certFiles[i], err)
+		}
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("parsing %s: %s", cs.certFiles[i], err)
+		}
+		certs[i] = &cert
+
+		certNames := cert.Leaf.DNSNames
+		if len(certNames) == 0 && cert.Leaf.Subject.CommonName != "" {
+			certNames = []string{cert.Leaf.Subject.CommonName}
+		}
+		for _, name := range certNames {
+			if _, ok := names[strings.ToLower(name)]; !ok {
+				names[strings.ToLower(name)] = &cert
+			}
+		}
+	}
+
+	cs.mutex.Lock()
+	cs.certs, cs.names = certs, names
+	cs.mutex.Unlock()
+	return nil
+}
+
+// getCertificate matches the SNI name exactly first, then against wildcard
+// certificates, and falls back to the first certificate.
+func (cs *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cs.mutex.RLock()
+	defer cs.mutex.RUnlock()
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := cs.names[name]; ok {
+		return cert, nil
+	}
+	if i := strings.Index(name, "."); i > 0 {
+		if cert, ok := cs.names["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+	return cs.certs[0], nil
+}
+
+func (cs *certStore) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cs.getCertificate,
+	}
+}
+
+// newUpstreamTLS builds the client configuration for HTTPs backends. Without
+// a CA bundle the system roots are trusted, without a certificate no client
+// authentication is done.
+func newUpstreamTLS(caFile, certFile, keyFile string) (*tls.Config, error) {
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		bundle, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// upstreamConfig returns the TLS client configuration for connecting to host.
+func upstreamConfig(host string) *tls.Config {
+	config := &tls.Config{}
+	if upstreamTLS != nil {
+		config = upstreamTLS.Clone()
+	}
+	config.ServerName = host
+	return config
+}
+
+// configureUpstream sets up the transport to backends from the upstream TLS flags.
+func configureUpstream() error {
+	config, err := newUpstreamTLS(*upstreamCA, *upstreamCert, *upstreamKey)
+	if err != nil {
+		return err
+	}
+	upstreamTLS = config
+	transport = newTransport()
+	return nil
+}
+
+// newTransport returns a transport to backends using the upstream TLS configuration.
+func newTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = upstreamTLS
+	return t
+}
+
+// splitList splits a comma-separated flag value, dropping empty items.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
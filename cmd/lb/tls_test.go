@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"time"
+
+	gocheck "gopkg.in/check.v1"
+)
+
+type MySuiteTLS struct {
+	dir     string
+	ca      *x509.Certificate
+	caKey   *ecdsa.PrivateKey
+	servers []*httptest.Server
+}
+
+var _ = gocheck.Suite(&MySuiteTLS{})
+
+func (s *MySuiteTLS) SetUpTest(c *gocheck.C) {
+	s.dir = c.MkDir()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, gocheck.IsNil)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, gocheck.IsNil)
+	s.ca, err = x509.ParseCertificate(der)
+	c.Assert(err, gocheck.IsNil)
+	s.caKey = key
+	s.write(c, "ca.pem", "CERTIFICATE", der)
+}
+
+func (s *MySuiteTLS) TearDownTest(c *gocheck.C) {
+	for _, ts := range s.servers {
+		ts.Close()
+	}
+	s.servers = nil
+	upstreamTLS = nil
+	transport = http.DefaultTransport
+	*https = false
+	*upstreamCA = ""
+}
+
+func (s *MySuiteTLS) write(c *gocheck.C, name, kind string, der []byte) string {
+	path := filepath.Join(s.dir, name)
+	err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0o600)
+	c.Assert(err, gocheck.IsNil)
+	return path
+}
+
+// issue writes a certificate for names signed by the test CA and returns
+// the paths of the certificate and its key.
+func (s *MySuiteTLS) issue(c *gocheck.C, prefix string, serial int64, names ...string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, gocheck.IsNil)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: prefix},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, s.ca, &key.PublicKey, s.caKey)
+	c.Assert(err, gocheck.IsNil)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, gocheck.IsNil)
+	return s.write(c, prefix+".pem", "CERTIFICATE", der), s.write(c, prefix+".key", "EC PRIVATE KEY", keyDer)
+}
+
+func (s *MySuiteTLS) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(s.ca)
+	return pool
+}
+
+func served(c *gocheck.C, cs *certStore, name string) *x509.Certificate {
+	cert, err := cs.getCertificate(&tls.ClientHelloInfo{ServerName: name})
+	c.Assert(err, gocheck.IsNil)
+	return cert.Leaf
+}
+
+func (s *MySuiteTLS) TestSNI(c *gocheck.C) {
+	aCert, aKey := s.issue(c, "a", 2, "a.example.com")
+	bCert, bKey := s.issue(c, "b", 3, "*.b.example.com")
+	cs, err := newCertStore([]string{aCert, bCert}, []string{aKey, bKey})
+	c.Assert(err, gocheck.IsNil)
+
+	c.Check(served(c, cs, "a.example.com").Subject.CommonName, gocheck.Equals, "a")
+	c.Check(served(c, cs, "API.b.example.com").Subject.CommonName, gocheck.Equals, "b")
+	c.Check(served(c, cs, "unknown.example.com").Subject.CommonName, gocheck.Equals, "a")
+	c.Check(served(c, cs, "").Subject.CommonName, gocheck.Equals, "a")
+
+	_, err = newCertStore([]string{aCert, bCert}, []string{aKey})
+	c.Check(err, gocheck.NotNil)
+}
+
+func (s *MySuiteTLS) TestReload(c *gocheck.C) {
+	cert, key := s.issue(c, "site", 2, "site.example.com")
+	cs, err := newCertStore([]string{cert}, []string{key})
+	c.Assert(err, gocheck.IsNil)
+	c.Check(served(c, cs, "site.example.com").SerialNumber.Int64(), gocheck.Equals, int64(2))
+
+	s.issue(c, "site", 5, "site.example.com")
+	c.Assert(cs.reload(), gocheck.IsNil)
+	c.Check(served(c, cs, "site.example.com").SerialNumber.Int64(), gocheck.Equals, int64(5))
+
+	c.Assert(ioutil.WriteFile(cert, []byte("garbage"), 0o600), gocheck.IsNil)
+	c.Check(cs.reload(), gocheck.NotNil)
+	c.Check(served(c, cs, "site.example.com").SerialNumber.Int64(), gocheck.Equals, int64(5))
+}
+
+func (s *MySuiteTLS) TestTermination(c *gocheck.C) {
+	var proto string
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		proto = r.Header.Get("X-Forwarded-Proto")
+	}))
+	s.servers = append(s.servers, backend)
+
+	cert, key := s.issue(c, "lb", 2, "lb.example.com")
+	cs, err := newCertStore([]string{cert}, []string{key})
+	c.Assert(err, gocheck.IsNil)
+	lb := httptest.NewUnstartedServer(testFrontend(hostOf(backend)))
+	lb.TLS = cs.tlsConfig()
+	lb.StartTLS()
+	s.servers = append(s.servers, lb)
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:    s.pool(),
+		ServerName: "lb.example.com",
+	}}}
+	resp, err := client.Get(lb.URL)
+	c.Assert(err, gocheck.IsNil)
+	resp.Body.Close()
+	c.Check(resp.StatusCode, gocheck.Equals, http.StatusOK)
+	c.Check(proto, gocheck.Equals, "https")
+}
+
+func (s *MySuiteTLS) TestUpstreamMutualTLS(c *gocheck.C) {
+	serverCert, serverKey := s.issue(c, "backend", 2, "127.0.0.1")
+	pair, err := tls.LoadX509KeyPair(serverCert, serverKey)
+	c.Assert(err, gocheck.IsNil)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, _ = rw.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	backend.TLS = &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    s.pool(),
+	}
+	backend.StartTLS()
+	s.servers = append(s.servers, backend)
+	*https = true
+
+	clientCert, clientKey := s.issue(c, "lb-client", 3)
+	upstreamTLS, err = newUpstreamTLS(filepath.Join(s.dir, "ca.pem"), clientCert, clientKey)
+	c.Assert(err, gocheck.IsNil)
+	transport = newTransport()
+
+	rec := httptest.NewRecorder()
+	testFrontend(hostOf(backend)).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	c.Check(rec.Code, gocheck.Equals, http.StatusOK)
+	c.Check(rec.Body.String(), gocheck.Equals, "lb-client")
+
+	// Without a client certificate the backend refuses the handshake.
+	upstreamTLS, err = newUpstreamTLS(filepath.Join(s.dir, "ca.pem"), "", "")
+	c.Assert(err, gocheck.IsNil)
+	transport = newTransport()
+	rec = httptest.NewRecorder()
+	testFrontend(hostOf(backend)).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	c.Check(rec.Code, gocheck.Equals, http.StatusServiceUnavailable)
+}
+
+func (s *MySuiteTLS) TestFirstHealthCheckUpstreamTLS(c *gocheck.C) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+	s.servers = append(s.servers, ts)
+	*https = true
+	*upstreamCA = s.write(c, "backend.pem", "CERTIFICATE", ts.Certificate().Raw)
+	c.Assert(configureUpstream(), gocheck.IsNil)
+
+	// Only the first check can bring the backend up before the test ends.
+	pool, err := Initialize([]backend{{
+		Host:   hostOf(ts).host,
+		Health: healthConfig{Interval: duration(time.Hour), Rise: 5},
+	}}, &leastConnections{})
+	c.Assert(err, gocheck.IsNil)
+	server := pool.servers[0]
+	pool.setStatus(server, false)
+	checks := newHealthChecks(pool)
+	checks.start(server)
+	defer checks.stop(server)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !pool.status()[0].Healthy && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(pool.status()[0].Healthy, gocheck.Equals, true)
+}
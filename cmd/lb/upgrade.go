@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ReallyGreatBand/lab2.2/tracing"
+)
+
+// isUpgrade reports whether r asks to switch the connection to another
+// protocol, such as a WebSocket handshake.
+func isUpgrade(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != "" && headerHasToken(r.Header, "Connection", "upgrade")
+}
+
+// headerHasToken reports whether the comma-separated header name lists token.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, value := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgrade proxies a protocol upgrade: the handshake is sent to a backend
+// over a dedicated connection and, once the backend switches protocols, the
+// client connection is hijacked and bytes are piped both ways. The
+// connection is counted on the backend until either side closes it.
+func (f *frontend) upgrade(rw *responseRecorder, r *http.Request, pool *serverPool) {
+	if _, ok := rw.ResponseWriter.(http.Hijacker); !ok {
+		log.Println("Upgrade is not supported by the client connection")
+		f.fail(rw, 0, http.StatusInternalServerError)
+		return
+	}
+
+	server, restore, err := pool.acquire(r)
+	if err != nil {
+		log.Println(err)
+		f.fail(rw, 0, http.StatusInternalServerError)
+		return
+	}
+	defer restore()
+	rw.backend, rw.attempts = server.host, 1
+
+	started := time.Now()
+	backendConn, resp, err := handshake(r.Context(), server.host, pool.sequence(server), r)
+	if err != nil {
+		if r.Context().Err() == nil {
+			pool.report(server, false, 0)
+		} else {
+			pool.abandon(server)
+		}
+		log.Printf("Failed to upgrade connection to %s: %s", server.host, err)
+		f.fail(rw, 1, http.StatusServiceUnavailable)
+		return
+	}
+	defer backendConn.Close()
+	pool.report(server, resp.StatusCode < http.StatusInternalServerError, time.Since(started))
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		_ = writeResponse(server.host, rw, resp)
+		return
+	}
+
+	clientConn, clientBuf, err := rw.Hijack()
+	if err != nil {
+		log.Printf("Failed to hijack client connection: %s", err)
+		return
+	}
+	defer clientConn.Close()
+	// The server deadlines were meant for a single request.
+	_ = clientConn.SetDeadline(time.Time{})
+
+	resp.Header.Add("Via", via(resp.ProtoMajor, resp.ProtoMinor))
+	resp.Header.Set(tracing.RequestIDHeader, rw.Header().Get(tracing.RequestIDHeader))
+	if *traceEnabled {
+		resp.Header.Set("lb-from", server.host)
+	}
+	if _, err := fmt.Fprintf(clientBuf, "HTTP/1.1 %s\r\n", resp.Status); err != nil {
+		return
+	}
+	if err := resp.Header.Write(clientBuf); err != nil {
+		return
+	}
+	if _, err := clientBuf.WriteString("\r\n"); err != nil {
+		return
+	}
+	if err := clientBuf.Flush(); err != nil {
+		return
+	}
+
+	log.Println("upgraded", server.host, r.URL)
+	pipe(clientConn, clientBuf.Reader, backendConn)
+}
+
+// bufferedConn reads through the reader the handshake response was parsed
+// with, as it may hold bytes the backend sent right after switching protocols.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// handshake dials dst and sends it the upgrade request r numbered seq. The
+// returned connection has to be closed by the caller.
+func handshake(ctx context.Context, dst string, seq uint64, r *http.Request) (net.Conn, *http.Response, error) {
+	dialer := &net.Dialer{Timeout: timeout()}
+	conn, err := dialer.DialContext(ctx, "tcp", dst)
+	if err != nil {
+		return nil, nil, err
+	}
+	if *https {
+		host, _, _ := net.SplitHostPort(dst)
+		conn = tls.Client(conn, upstreamConfig(host))
+	}
+	_ = conn.SetDeadline(time.Now().Add(timeout()))
+
+	upgradeTo := r.Header.Get("Upgrade")
+	outRequest := r.Clone(ctx)
+	outRequest.URL.Host = dst
+	outRequest.URL.Scheme = scheme()
+	outRequest.Host = dst
+	outRequest.Body = nil
+	removeHopHeaders(outRequest.Header)
+	addForwardingHeaders(outRequest.Header, r)
+	tracing.Inject(ctx, outRequest.Header)
+	stamp(outRequest.Header, seq)
+	outRequest.Header.Set("Connection", "Upgrade")
+	outRequest.Header.Set("Upgrade", upgradeTo)
+
+	if err := outRequest.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, outRequest)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		upgradeHeader := resp.Header.Get("Upgrade")
+		removeHopHeaders(resp.Header)
+		resp.Header.Set("Connection", "Upgrade")
+		resp.Header.Set("Upgrade", upgradeHeader)
+	}
+	return &bufferedConn{Conn: conn, reader: reader}, resp, nil
+}
+
+// pipe copies bytes between the client and the backend until one of them
+// closes its side, then closes both connections.
+func pipe(client net.Conn, fromClient io.Reader, backend net.Conn) {
+	var (
+		once      sync.Once
+		wg        sync.WaitGroup
+		closeBoth = func() {
+			client.Close()
+			backend.Close()
+		}
+	)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(backend, fromClient)
+		once.Do(closeBoth)
+	}()
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(client, backend)
+		once.Do(closeBoth)
+	}()
+	wg.Wait()
+}
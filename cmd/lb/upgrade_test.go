@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	gocheck "gopkg.in/check.v1"
+)
+
+type MySuiteUpgrade struct {
+	servers []*httptest.Server
+}
+
+var _ = gocheck.Suite(&MySuiteUpgrade{})
+
+func (s *MySuiteUpgrade) TearDownTest(c *gocheck.C) {
+	for _, ts := range s.servers {
+		ts.Close()
+	}
+	s.servers = nil
+}
+
+// echoBackend switches to an "echo" protocol that sends every line back.
+func echoBackend(rw http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upgrade") != "echo" {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	conn, buf, err := rw.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	_, _ = buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\nready\n")
+	_ = buf.Flush()
+	for {
+		line, err := buf.ReadString('\n')
+		if err != nil {
+			return
+		}
+		_, _ = buf.WriteString(line)
+		_ = buf.Flush()
+	}
+}
+
+func (s *MySuiteUpgrade) start() (*serverPool, string) {
+	backend := httptest.NewServer(http.HandlerFunc(echoBackend))
+	f := testFrontend(hostOf(backend))
+	lb := httptest.NewServer(f)
+	s.servers = append(s.servers, backend, lb)
+	u, _ := url.Parse(lb.URL)
+	return f.pool, u.Host
+}
+
+func (s *MySuiteUpgrade) connections(pool *serverPool) int {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	return pool.servers[0].counter
+}
+
+func (s *MySuiteUpgrade) TestEcho(c *gocheck.C) {
+	pool, host := s.start()
+
+	conn, err := net.Dial("tcp", host)
+	c.Assert(err, gocheck.IsNil)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /echo HTTP/1.1\r\nHost: " + host + "\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+	c.Assert(err, gocheck.IsNil)
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	c.Assert(err, gocheck.IsNil)
+	c.Assert(resp.StatusCode, gocheck.Equals, http.StatusSwitchingProtocols)
+	c.Check(resp.Header.Get("Upgrade"), gocheck.Equals, "echo")
+
+	line, err := reader.ReadString('\n')
+	c.Assert(err, gocheck.IsNil)
+	c.Check(line, gocheck.Equals, "ready\n")
+	_, err = conn.Write([]byte("hello\n"))
+	c.Assert(err, gocheck.IsNil)
+	line, err = reader.ReadString('\n')
+	c.Assert(err, gocheck.IsNil)
+	c.Check(line, gocheck.Equals, "hello\n")
+	c.Check(s.connections(pool), gocheck.Equals, 1)
+
+	conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for s.connections(pool) != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Check(s.connections(pool), gocheck.Equals, 0)
+}
+
+func (s *MySuiteUpgrade) TestRefused(c *gocheck.C) {
+	pool, host := s.start()
+
+	req, _ := http.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "unknown")
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, gocheck.IsNil)
+	resp.Body.Close()
+	c.Check(resp.StatusCode, gocheck.Equals, http.StatusBadRequest)
+	c.Check(s.connections(pool), gocheck.Equals, 0)
+}
@@ -4,29 +4,52 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"sync"
 )
 
 const reportMaxLen = 100
 
-type Report map[string][]string
+// Report keeps the last request counters seen from every balancer. It is
+// shared by concurrent handlers, so the map is guarded by the mutex.
+type Report struct {
+	mutex   sync.Mutex
+	authors map[string][]string
+}
+
+func NewReport() *Report {
+	return &Report{authors: make(map[string][]string)}
+}
 
-func (r Report) Process(req *http.Request) {
+func (r *Report) Process(req *http.Request) {
 	author := req.Header.Get("lb-author")
 	counter := req.Header.Get("lb-req-cnt")
 	log.Printf("GET some-data from [%s] request [%s]", author, counter)
 
 	if len(author) > 0 {
-		list := r[author]
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		list := r.authors[author]
 		list = append(list, counter)
 		if len(list) > reportMaxLen {
 			list = list[len(list)-reportMaxLen:]
 		}
-		r[author] = list
+		r.authors[author] = list
+	}
+}
+
+// snapshot returns a copy of the counters by author.
+func (r *Report) snapshot() map[string][]string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	authors := make(map[string][]string, len(r.authors))
+	for author, list := range r.authors {
+		authors[author] = append([]string(nil), list...)
 	}
+	return authors
 }
 
-func (r Report) ServeHTTP(rw http.ResponseWriter, _ *http.Request) {
+func (r *Report) ServeHTTP(rw http.ResponseWriter, _ *http.Request) {
 	rw.Header().Set("content-type", "application/json")
 	rw.WriteHeader(http.StatusOK)
-	_ = json.NewEncoder(rw).Encode(r)
+	_ = json.NewEncoder(rw).Encode(r.snapshot())
 }
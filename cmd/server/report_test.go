@@ -1,8 +1,11 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http/httptest"
 	"reflect"
+	"sync"
 	"testing"
 )
 
@@ -11,17 +14,17 @@ func TestReport_Process(t *testing.T) {
 	req.Header.Set("lb-author", "test-author")
 	req.Header.Set("lb-req-cnt", "1")
 
-	r := make(Report)
+	r := NewReport()
 
 	r.Process(req)
-	if !reflect.DeepEqual(r["test-author"], []string{"1"}) {
-		t.Errorf("Unexpected report state %s", r)
+	if !reflect.DeepEqual(r.snapshot()["test-author"], []string{"1"}) {
+		t.Errorf("Unexpected report state %s", r.snapshot())
 	}
 
 	req.Header.Set("lb-req-cnt", "2")
 	r.Process(req)
-	if !reflect.DeepEqual(r["test-author"], []string{"1", "2"}) {
-		t.Errorf("Unexpected report state %s", r)
+	if !reflect.DeepEqual(r.snapshot()["test-author"], []string{"1", "2"}) {
+		t.Errorf("Unexpected report state %s", r.snapshot())
 	}
 
 	req.Header.Set("lb-author", "test-len")
@@ -29,7 +32,39 @@ func TestReport_Process(t *testing.T) {
 		req.Header.Set("lb-req-cnt", "test-len")
 		r.Process(req)
 	}
-	if len(r["test-len"]) != reportMaxLen {
-		t.Errorf("Unexpectd error length: %d", len(r["test-len"]))
+	if len(r.snapshot()["test-len"]) != reportMaxLen {
+		t.Errorf("Unexpectd error length: %d", len(r.snapshot()["test-len"]))
+	}
+}
+
+func TestReport_Concurrent(t *testing.T) {
+	r := NewReport()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				req := httptest.NewRequest("GET", "/api/v1/some-data", nil)
+				req.Header.Set("lb-author", fmt.Sprintf("lb%d", i%2))
+				req.Header.Set("lb-req-cnt", fmt.Sprint(j))
+				r.Process(req)
+
+				rec := httptest.NewRecorder()
+				r.ServeHTTP(rec, httptest.NewRequest("GET", "/report", nil))
+				var report map[string][]string
+				if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+					t.Errorf("Cannot decode report: %s", err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, author := range []string{"lb0", "lb1"} {
+		if n := len(r.snapshot()[author]); n != reportMaxLen {
+			t.Errorf("Unexpected number of counters from %s: %d", author, n)
+		}
 	}
 }
@@ -13,6 +13,7 @@ import (
 
 	"github.com/ReallyGreatBand/lab2.2/httptools"
 	"github.com/ReallyGreatBand/lab2.2/signal"
+	"github.com/ReallyGreatBand/lab2.2/tracing"
 )
 
 var port = flag.Int("port", 8080, "server port")
@@ -40,7 +41,7 @@ func main() {
 		}
 	})
 
-	report := make(Report)
+	report := NewReport()
 
 	h.HandleFunc("/api/v1/some-data", func(rw http.ResponseWriter, r *http.Request) {
 		_ = os.Setenv(confResponseDelaySec, "1")
@@ -60,12 +61,15 @@ func main() {
 			return
 		}
 
-		body, err := http.Get(*db + key[0])
+		dbRequest, _ := http.NewRequestWithContext(r.Context(), http.MethodGet, *db+key[0], nil)
+		tracing.Inject(r.Context(), dbRequest.Header)
+		body, err := http.DefaultClient.Do(dbRequest)
 		if err != nil {
 			log.Printf("Error sending request to database: %s", err)
 			rw.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		defer body.Body.Close()
 		if body.StatusCode != http.StatusOK {
 			switch body.StatusCode {
 			case http.StatusNotFound:
@@ -95,7 +99,7 @@ func main() {
 
 	h.Handle("/report", report)
 
-	server := httptools.CreateServer(*port, h)
+	server := httptools.CreateServer(*port, tracing.Handler(h))
 	date := "2010-05-29"
 	res, err := http.Post(*db + "reallygreatband", "application/json", bytes.NewBuffer([]byte(fmt.Sprintf(`{"value": "%s"}`, date))))
 	if err != nil || res.StatusCode != http.StatusOK {
@@ -5,11 +5,16 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
+	"os"
+	"sort"
+	"strconv"
 	"time"
 )
 
 var https = flag.Bool("https", false, "whether backends support HTTPs")
+var tolerance = flag.Float64("tolerance", 0.2, "largest allowed relative deviation of a server's requests from the mean")
 
 var serversPool = []string{
 	"localhost:8080",
@@ -40,23 +45,95 @@ func main()  {
 			if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
 				//log.Printf("error parsing from %s: %s", s, err)
 			} else {
-				for k, v := range data {
-					l := len(v)
-					if l > 5 {
-						l = 5
-					}
-					data[k] = v[len(v)-l:]
-				}
 				res[i] = data
 			}
+			resp.Body.Close()
 		} else {
 			log.Printf("error %s %s", s, err)
 		}
 
+		latest := make(report, len(res[i]))
+		for k, v := range res[i] {
+			l := len(v)
+			if l > 5 {
+				l = 5
+			}
+			latest[k] = v[len(v)-l:]
+		}
 		log.Println("=========================")
 		log.Println("SERVER", i, serversPool[i])
 		log.Println("=========================")
-		data, _ := json.MarshalIndent(res[i], "", "  ")
+		data, _ := json.MarshalIndent(latest, "", "  ")
 		log.Println(string(data))
 	}
+
+	log.Println("=========================")
+	log.Println("FAIRNESS")
+	log.Println("=========================")
+	if !fair(res, *tolerance) {
+		os.Exit(1)
+	}
+}
+
+// sent returns how many requests author forwarded to the server of rep. The
+// balancer numbers the requests to every server, so this is the highest
+// lb-req-cnt the server saw.
+func sent(rep report, author string) int {
+	highest := 0
+	for _, counter := range rep[author] {
+		if n, err := strconv.Atoi(counter); err == nil && n > highest {
+			highest = n
+		}
+	}
+	return highest
+}
+
+// fair reports whether every balancer spread its requests over the servers
+// evenly, within tolerance of the mean.
+func fair(reports []report, tolerance float64) bool {
+	authors := make(map[string]bool)
+	for _, rep := range reports {
+		for author := range rep {
+			authors[author] = true
+		}
+	}
+	if len(authors) == 0 {
+		log.Println("no requests from any balancer were reported")
+		return false
+	}
+	names := make([]string, 0, len(authors))
+	for author := range authors {
+		names = append(names, author)
+	}
+	sort.Strings(names)
+
+	balanced := true
+	for _, author := range names {
+		total := 0
+		counts := make([]int, len(reports))
+		for i, rep := range reports {
+			counts[i] = sent(rep, author)
+			total += counts[i]
+		}
+		mean := float64(total) / float64(len(reports))
+		if mean == 0 {
+			// Counters that could not be read say nothing about the balance.
+			log.Printf("%s -> no counted requests on any server", author)
+			balanced = false
+			continue
+		}
+		for i, count := range counts {
+			deviation := math.Abs(float64(count)-mean) / mean
+			log.Printf("%s -> server %d: %d requests, %.0f%% off the mean", author, i, count, deviation*100)
+			if deviation > tolerance {
+				balanced = false
+			}
+		}
+	}
+	if balanced {
+		log.Printf("requests are balanced within %.0f%%", tolerance*100)
+	} else {
+		log.Printf("requests are NOT balanced within %.0f%%", tolerance*100)
+	}
+	return balanced
 }
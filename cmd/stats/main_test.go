@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestFair(t *testing.T) {
+	reports := []report{
+		{"lb-1": {"9", "10"}, "lb-2": {"4"}},
+		{"lb-1": {"10", "11"}, "lb-2": {"5"}},
+		{"lb-1": {"8", "x", "9"}, "lb-2": {"5"}},
+	}
+	if !fair(reports, 0.2) {
+		t.Errorf("Expected %v to be balanced", reports)
+	}
+	if sent(reports[2], "lb-1") != 9 {
+		t.Errorf("Unexpected count of sent requests %d", sent(reports[2], "lb-1"))
+	}
+
+	reports[2]["lb-2"] = []string{"1"}
+	if fair(reports, 0.2) {
+		t.Errorf("Expected %v to be unbalanced", reports)
+	}
+	if fair([]report{nil, nil, nil}, 0.2) {
+		t.Errorf("Expected empty reports to fail")
+	}
+	if fair([]report{{"lb-1": {"x"}}, {"lb-1": {"0"}}, {}}, 0.2) {
+		t.Errorf("Expected an author without counted requests to fail")
+	}
+}
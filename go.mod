@@ -2,4 +2,7 @@ module github.com/ReallyGreatBand/lab2.2
 
 go 1.15
 
-require gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c
+require (
+	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -1,6 +1,7 @@
 package httptools
 
 import (
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net/http"
@@ -18,15 +19,25 @@ type server struct {
 func (s server) Start() {
 	go func() {
 		log.Println("Staring the HTTP server...")
-		err := s.httpServer.ListenAndServe()
+		var err error
+		if s.httpServer.TLSConfig != nil {
+			err = s.httpServer.ListenAndServeTLS("", "")
+		} else {
+			err = s.httpServer.ListenAndServe()
+		}
 		log.Fatalf("HTTP server finished: %s. Finishing the process.", err)
 	}()
 }
 
 func CreateServer(port int, handler http.Handler) Server {
+	return CreateServerAt(fmt.Sprintf(":%d", port), handler)
+}
+
+// CreateServerAt is CreateServer listening on addr rather than on a port of all interfaces.
+func CreateServerAt(addr string, handler http.Handler) Server {
 	return server{
 		httpServer: &http.Server{
-			Addr:           fmt.Sprintf(":%d", port),
+			Addr:           addr,
 			Handler:        handler,
 			ReadTimeout:    10 * time.Second,
 			WriteTimeout:   10 * time.Second,
@@ -34,3 +45,10 @@ func CreateServer(port int, handler http.Handler) Server {
 		},
 	}
 }
+
+// CreateTLSServer is CreateServer terminating TLS with certificates provided by config.
+func CreateTLSServer(port int, handler http.Handler, config *tls.Config) Server {
+	s := CreateServer(port, handler).(server)
+	s.httpServer.TLSConfig = config
+	return s
+}
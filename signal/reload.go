@@ -0,0 +1,18 @@
+package signal
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// NotifyReload calls reload every time the process receives SIGHUP.
+func NotifyReload(reload func()) {
+	hupChannel := make(chan os.Signal, 1)
+	signal.Notify(hupChannel, syscall.SIGHUP)
+	go func() {
+		for range hupChannel {
+			reload()
+		}
+	}()
+}
@@ -0,0 +1,136 @@
+// Package tracing carries request IDs and W3C trace context (the traceparent
+// header) between the balancer, the servers and the database.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const (
+	RequestIDHeader   = "X-Request-ID"
+	TraceparentHeader = "traceparent"
+)
+
+// maxRequestID limits the length of request IDs accepted from clients.
+const maxRequestID = 128
+
+// Trace identifies a request and the span of the service handling it.
+type Trace struct {
+	RequestID string
+	TraceID   string
+	// SpanID is the span of the caller, sent as the parent-id of traceparent.
+	SpanID string
+	Flags  string
+}
+
+// New starts a trace with fresh IDs.
+func New() Trace {
+	return Trace{
+		RequestID: randomHex(16),
+		TraceID:   randomHex(16),
+		SpanID:    randomHex(8),
+		Flags:     "01",
+	}
+}
+
+// FromRequest continues the trace of r. Missing or malformed parts are
+// replaced by fresh IDs.
+func FromRequest(r *http.Request) Trace {
+	t := New()
+	if id := r.Header.Get(RequestIDHeader); id != "" && len(id) <= maxRequestID {
+		t.RequestID = id
+	}
+	if traceID, spanID, flags, ok := parseTraceparent(r.Header.Get(TraceparentHeader)); ok {
+		t.TraceID, t.SpanID, t.Flags = traceID, spanID, flags
+	}
+	return t
+}
+
+// Child returns the trace for a call made on behalf of t, it keeps the IDs
+// of the request and the trace but gets a span of its own.
+func (t Trace) Child() Trace {
+	t.SpanID = randomHex(8)
+	return t
+}
+
+// Set writes the trace into the headers of an outgoing request.
+func (t Trace) Set(h http.Header) {
+	h.Set(RequestIDHeader, t.RequestID)
+	h.Set(TraceparentHeader, fmt.Sprintf("00-%s-%s-%s", t.TraceID, t.SpanID, t.Flags))
+}
+
+func (t Trace) String() string {
+	return fmt.Sprintf("request=%s trace=%s", t.RequestID, t.TraceID)
+}
+
+// parseTraceparent parses a version 00 traceparent header.
+func parseTraceparent(value string) (traceID, spanID, flags string, ok bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) != 4 || parts[0] != "00" {
+		return "", "", "", false
+	}
+	traceID, spanID, flags = parts[1], parts[2], parts[3]
+	if !isHex(traceID, 32) || !isHex(spanID, 16) || !isHex(flags, 2) ||
+		traceID == strings.Repeat("0", 32) || spanID == strings.Repeat("0", 16) {
+		return "", "", "", false
+	}
+	return traceID, spanID, flags, true
+}
+
+func isHex(s string, length int) bool {
+	if len(s) != length {
+		return false
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("Failed to generate a trace ID: %s", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying t.
+func NewContext(ctx context.Context, t Trace) context.Context {
+	return context.WithValue(ctx, contextKey{}, t)
+}
+
+// FromContext returns the trace stored in ctx.
+func FromContext(ctx context.Context) (Trace, bool) {
+	t, ok := ctx.Value(contextKey{}).(Trace)
+	return t, ok
+}
+
+// Inject sets the headers of a request made while handling ctx, so that the
+// callee continues the same trace.
+func Inject(ctx context.Context, h http.Header) {
+	if t, ok := FromContext(ctx); ok {
+		t.Child().Set(h)
+	}
+}
+
+// Handler continues the trace of every request, logs it, echoes the request
+// ID in the response and makes the trace available via FromContext.
+func Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		t := FromRequest(r)
+		log.Printf("%s %s %s", r.Method, r.URL.Path, t)
+		rw.Header().Set(RequestIDHeader, t.RequestID)
+		next.ServeHTTP(rw, r.WithContext(NewContext(r.Context(), t)))
+	})
+}
@@ -0,0 +1,66 @@
+package tracing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFromRequest(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(RequestIDHeader, "abc")
+	r.Header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	tr := FromRequest(r)
+	if tr.RequestID != "abc" || tr.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || tr.SpanID != "00f067aa0ba902b7" {
+		t.Errorf("Unexpected trace %+v", tr)
+	}
+
+	child := tr.Child()
+	if child.TraceID != tr.TraceID || child.RequestID != tr.RequestID || child.SpanID == tr.SpanID {
+		t.Errorf("Unexpected child trace %+v of %+v", child, tr)
+	}
+	h := make(http.Header)
+	child.Set(h)
+	if expected := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + child.SpanID + "-01"; h.Get(TraceparentHeader) != expected {
+		t.Errorf("Unexpected traceparent %s, expected %s", h.Get(TraceparentHeader), expected)
+	}
+}
+
+func TestFromRequest_Malformed(t *testing.T) {
+	for _, traceparent := range []string{
+		"",
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set(TraceparentHeader, traceparent)
+		tr := FromRequest(r)
+		if len(tr.TraceID) != 32 || tr.TraceID == "4bf92f3577b34da6a3ce929d0e0e4736" || len(tr.RequestID) != 32 {
+			t.Errorf("Malformed traceparent %q gave trace %+v", traceparent, tr)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	var inner Trace
+	h := Handler(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		inner, _ = FromContext(r.Context())
+		out := make(http.Header)
+		Inject(r.Context(), out)
+		if out.Get(RequestIDHeader) != "abc" || out.Get(TraceparentHeader) == "" {
+			t.Errorf("Unexpected injected headers %v", out)
+		}
+	}))
+
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(RequestIDHeader, "abc")
+	h.ServeHTTP(rec, r)
+	if inner.RequestID != "abc" || rec.Header().Get(RequestIDHeader) != "abc" {
+		t.Errorf("Unexpected trace %+v, response header %s", inner, rec.Header().Get(RequestIDHeader))
+	}
+}